@@ -0,0 +1,80 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// returned (wrapped) when the remote file was replaced while we were downloading it
+var ErrRemoteChanged = errors.New("remote file changed during download")
+
+// how many times a download may start over with --restart-on-change before giving up
+const maxChangeRestarts = 3
+
+type RemoteChangedError struct {
+	URL       string
+	Old       Validators
+	New       Validators
+	TotalSize int64 // size of the new file, -1 when the server did not tell
+}
+
+func (e *RemoteChangedError) Error() string {
+	if e.Old.ETag != "" {
+		return fmt.Sprintf("%v: %s ETag changed from %s to %s", ErrRemoteChanged, e.URL, e.Old.ETag, e.New.ETag)
+	}
+	return fmt.Sprintf("%v: %s Last-Modified changed from %s to %s", ErrRemoteChanged, e.URL, e.Old.LastModified, e.New.LastModified)
+}
+
+func (e *RemoteChangedError) Is(target error) bool {
+	return target == ErrRemoteChanged
+}
+
+func validatorsFromResponse(resp *http.Response) Validators {
+	return Validators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+}
+
+// ifRangeValue picks the validator to send in If-Range, weak ETags are not allowed there
+func ifRangeValue(v Validators) string {
+	if v.ETag != "" && !strings.HasPrefix(v.ETag, "W/") {
+		return v.ETag
+	}
+	return v.LastModified
+}
+
+// detectChange compares the validators of a response with the ones captured by the probe
+func detectChange(url string, v Validators, resp *http.Response, sentIfRange bool) *RemoteChangedError {
+	current := validatorsFromResponse(resp)
+
+	changed := false
+	switch {
+	case resp.StatusCode == http.StatusOK && sentIfRange:
+		// If-Range did not match so the server sent the whole (new) file instead of our range
+		changed = true
+	case v.ETag != "" && current.ETag != "":
+		changed = v.ETag != current.ETag
+	case v.LastModified != "" && current.LastModified != "":
+		changed = v.LastModified != current.LastModified
+	}
+	if !changed {
+		return nil
+	}
+
+	totalSize := int64(-1)
+	if resp.StatusCode == http.StatusOK {
+		totalSize = resp.ContentLength
+	} else if _, _, total, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil {
+		totalSize = total
+	}
+
+	return &RemoteChangedError{
+		URL:       url,
+		Old:       v,
+		New:       current,
+		TotalSize: totalSize,
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"hash"
 	"io"
 	"os"
+	"strings"
 )
 
 type ChecksumInfo struct {
@@ -32,6 +33,23 @@ var SupportedChecksum = map[string]ChecksumAlgo{
 	"sha512": {ChecksumLen: 128, NewHash: sha512.New},
 }
 
+// NewChecksumInfo checks that the algorithm is supported and the hash has the length it produces
+func NewChecksumInfo(algorithm string, expectedHash string) (*ChecksumInfo, error) {
+	algo := strings.ToLower(algorithm)
+	algoInfo, exists := SupportedChecksum[algo]
+	if !exists {
+		return nil, fmt.Errorf("algorithm '%s' is not supported", algo)
+	}
+	if len(expectedHash) != algoInfo.ChecksumLen {
+		return nil, fmt.Errorf("invalid %s checksum length. Expected %d characters, got %d", algo, algoInfo.ChecksumLen, len(expectedHash))
+	}
+	return &ChecksumInfo{
+		ExpectedHash: strings.ToLower(expectedHash),
+		AlgoName:     algo,
+		Algo:         algoInfo,
+	}, nil
+}
+
 func VerifyFile(filepath string, expectedHash string, algoInfo ChecksumAlgo) error {
 
 	f, err := os.Open(filepath)
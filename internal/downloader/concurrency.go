@@ -0,0 +1,197 @@
+package downloader
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const initialWorkers = 4
+const concurrencyStep = 2
+const concurrencyTick = 2 * time.Second
+const concurrencyHoldTicks = 5 // ticks to sit still after backing off before probing again
+
+// concurrencyController grows the worker pool while throughput keeps improving and shrinks it
+// when the server throttles us or an increase did not pay off (additive increase, multiplicative decrease)
+type concurrencyController struct {
+	target    int
+	lastSpeed float64
+	lastBytes int64
+	probing   bool // the last change was an increase that still has to prove itself
+	holdTicks int
+	throttled atomic.Bool  // set by workers when the server answers 429/503, or by the health policy
+	requested atomic.Int64 // workers the health policy asked to add (or retired, when negative)
+}
+
+// SetWorkerLimit changes the maximum number of workers, must be called before RangeDownload
+func (rdi *RangeDownloadInfo) SetWorkerLimit(limit int) {
+	limit = max(limit, 1)
+	workerSlice := make([]*WorkerInfo, limit)
+	for i := range workerSlice {
+		workerSlice[i] = newWorkerInfo(i)
+	}
+	rdi.Workers = Workers{
+		Limit: limit,
+		Slice: workerSlice,
+	}
+}
+
+// ActiveWorkers returns how many workers are currently running
+func (rdi *RangeDownloadInfo) ActiveWorkers() int {
+	rdi.poolMu.Lock()
+	defer rdi.poolMu.Unlock()
+	return rdi.activeWorkers()
+}
+
+// caller must hold poolMu
+func (rdi *RangeDownloadInfo) activeWorkers() int {
+	count := 0
+	for _, wi := range rdi.Workers.Slice {
+		if wi.running && !wi.retire.Load() {
+			count++
+		}
+	}
+	return count
+}
+
+// setActiveWorkers spawns parked workers or retires the slowest running ones until n are active
+func (rdi *RangeDownloadInfo) setActiveWorkers(n int) {
+	rdi.poolMu.Lock()
+	defer rdi.poolMu.Unlock()
+
+	active := rdi.activeWorkers()
+	if n > active {
+		for _, wi := range rdi.Workers.Slice {
+			if active == n {
+				break
+			}
+			if wi.running {
+				// a worker that was told to retire but has not exited yet can simply stay
+				if wi.retire.Swap(false) {
+					active++
+				}
+				continue
+			}
+			wi.running = true
+			wi.retire.Store(false)
+			wi.setStatus(WorkerStatusIdle)
+			rdi.Wg.Add(1)
+			go rdi.rangeDownloadWorker(wi)
+			active++
+		}
+		return
+	}
+
+	var running []WorkerSnapshot
+	for _, wi := range rdi.Workers.Slice {
+		if wi.running && !wi.retire.Load() {
+			running = append(running, wi.Snapshot())
+		}
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].Speed < running[j].Speed
+	})
+	for _, stats := range running[:active-n] {
+		rdi.Workers.Slice[stats.ID].retire.Store(true)
+	}
+}
+
+// retireWorker stops a specific worker once its current chunk is done and shrinks the pool by one
+func (rdi *RangeDownloadInfo) retireWorker(id int) {
+	rdi.poolMu.Lock()
+	defer rdi.poolMu.Unlock()
+
+	c := rdi.concurrency
+	wi := rdi.worker(id)
+	if c == nil || wi == nil {
+		return
+	}
+
+	// never retire the last worker
+	if !wi.running || wi.retire.Load() || rdi.activeWorkers() <= 1 {
+		return
+	}
+	c.requested.Add(-1)
+	wi.retire.Store(true)
+}
+
+// controller returns the concurrency controller of the current pass, nil before the first one
+func (rdi *RangeDownloadInfo) controller() *concurrencyController {
+	rdi.poolMu.Lock()
+	defer rdi.poolMu.Unlock()
+	return rdi.concurrency
+}
+
+// workerExited is called by a worker right before it returns
+func (rdi *RangeDownloadInfo) workerExited(wi *WorkerInfo) {
+	rdi.poolMu.Lock()
+	defer rdi.poolMu.Unlock()
+
+	wi.running = false
+	if wi.retire.Load() {
+		wi.setStatus(WorkerStatusParked)
+	} else {
+		wi.setStatus(WorkerStatusDone)
+	}
+}
+
+// liveBytes sums what every worker has written so far, unlike BytesWritten it moves with every read
+func (rdi *RangeDownloadInfo) liveBytes() int64 {
+	var total int64
+	for _, wi := range rdi.Workers.Slice {
+		total += wi.bytesWritten.Load()
+	}
+	return total
+}
+
+// runConcurrencyController adjusts the pool until the queue is drained, the caller has already
+// done Wg.Add(1) for it so Wait can not return while new workers may still be spawned
+func (rdi *RangeDownloadInfo) runConcurrencyController(c *concurrencyController) {
+	defer rdi.Wg.Done()
+
+	c.lastBytes = rdi.liveBytes()
+	lastTick := time.Now()
+
+	ticker := time.NewTicker(concurrencyTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rdi.sched.finished:
+			return
+		case <-rdi.ctx.Done():
+			return
+		case now := <-ticker.C:
+			bytes := rdi.liveBytes()
+			speed := float64(bytes-c.lastBytes) / now.Sub(lastTick).Seconds()
+			c.lastBytes = bytes
+			lastTick = now
+
+			requested := int(c.requested.Swap(0))
+			switch {
+			case c.throttled.Swap(false):
+				c.target = max(1, c.target/2)
+				c.probing = false
+				c.holdTicks = concurrencyHoldTicks
+			case requested != 0:
+				c.target = min(max(1, c.target+requested), rdi.Workers.Limit)
+				c.probing = false
+				c.holdTicks = concurrencyHoldTicks
+			case c.holdTicks > 0:
+				c.holdTicks--
+			case c.probing && speed < c.lastSpeed*1.05:
+				// the last increase did not pay off, undo it and stay there for a while
+				c.target = max(1, c.target-concurrencyStep)
+				c.probing = false
+				c.holdTicks = concurrencyHoldTicks
+			case c.target < min(rdi.Workers.Limit, int(rdi.sched.remaining()/minChunkSize)):
+				// more workers than there is work left to split would only sit idle
+				c.target = min(rdi.Workers.Limit, c.target+concurrencyStep)
+				c.probing = true
+			}
+			c.lastSpeed = speed
+
+			rdi.setActiveWorkers(c.target)
+		}
+	}
+}
@@ -1,13 +1,10 @@
 package downloader
 
 import (
-	"downpour/internal/utils"
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"math"
-	"mime"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,55 +13,14 @@ import (
 	"time"
 )
 
-// callback types
-type ProgressFunc func(n int64)
-type DoneFunc func()
-type ErrorFunc func(err error)
-type VerifyFunc func()
-
-const bufferSize = 64 * 1024         // 64KB
-const minChunkSize = 256 * 1024      // 256KB
-const maxChunkSize = 2 * 1024 * 1024 // 2MB
+const bufferSize = 64 * 1024           // 64KB
+const minChunkSize = 256 * 1024        // 256KB
+const maxChunkSize = 32 * 1024 * 1024  // 32MB, a fast worker gets few long requests
+const commitInterval = 2 * 1024 * 1024 // 2MB, progress, resume and readers move in steps of this size
 const workerLimit = 32
 
-func StreamDownload(u url.URL, onProgress ProgressFunc, onDone DoneFunc, onError ErrorFunc) {
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		onError(err)
-		return
-	}
-	req.Header.Set("User-Agent", "Mozilla/5.0")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		onError(err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		onError(fmt.Errorf("bad status: %s", resp.Status))
-		return
-	}
-
-	filename := GetFileName(&u, resp)
-
-	file, err := os.Create(filename)
-	if err != nil {
-		onError(err)
-		return
-	}
-
-	_, err = streamCopy(resp.Body, file, onProgress)
-	if err != nil {
-		onError(err)
-		return
-	}
-
-	onDone()
-	file.Close()
-}
+// reported (wrapped) in the Failed event when the context passed to a download is cancelled
+var ErrCancelled = errors.New("download cancelled")
 
 type StatusFlags struct {
 	EnableTrace     bool
@@ -76,67 +32,83 @@ type Workers struct {
 	Slice []*WorkerInfo
 }
 type RangeDownloadInfo struct {
-	ChunkChan           chan int
-	WriterPool          *sync.Pool
-	Wg                  *sync.WaitGroup
-	Workers             Workers
-	TotalChunks         int64
-	ChunkSize           int64
-	TotalSize           int64
-	BytesWritten        *atomic.Int64
-	ReqURL              string
-	Filename            string
-	DirName             string
-	File                *os.File
-	StatusFlags         StatusFlags
-	Checksum            *ChecksumInfo
-	WorkerBaselineSpeed float64
+	sched           *scheduler
+	WriterPool      *sync.Pool
+	Wg              *sync.WaitGroup
+	Workers         Workers
+	poolMu          sync.Mutex
+	concurrency     *concurrencyController // guarded by poolMu, replaced on every pass while the health monitor runs
+	TotalSize       int64
+	BytesWritten    *atomic.Int64
+	ReqURL          string
+	Filename        string
+	DirName         string
+	File            *os.File
+	StatusFlags     StatusFlags
+	Checksum        *ChecksumInfo
+	baseline        float64 // guarded by poolMu, speed the health policy expects of a healthy worker
+	HealthPolicy    HealthPolicy
+	Validators      Validators
+	State           *ResumeState
+	Mirrors         *MirrorSet
+	RetryPolicy     RetryPolicy
+	Timeouts        Timeouts
+	ErrorPolicy     ErrorPolicy
+	failures        *failureLog
+	RestartOnChange bool
+	DiscardPartial  bool        // delete the partial file instead of keeping it for resume
+	Header          http.Header // sent with every request, Range and If-Range are set by the download itself
+	ChunkSize       int64       // size of the ranges handed to workers, 0 sizes them by worker speed
+	Sequential      bool        // keep the file usable from the start: lowest ranges first, work stays close to the contiguous prefix
+	Events          *EventBus
+	demand          *demand       // ranges readers of the partial file are blocked on
+	fetcher         *rangeFetcher // requests, validates and retries the ranges of the workers
+	ctx             context.Context
+	cancel          context.CancelCauseFunc
 }
 
-func InitRangeDownloadInfo(filename string, totalSize int64, reqURl string, statusFlags StatusFlags) (*RangeDownloadInfo, error) {
-	chunkSize := int64(maxChunkSize)
-	if totalSize < minChunkSize {
-		chunkSize = totalSize
+func InitRangeDownloadInfo(filename string, totalSize int64, reqURl string, validators Validators, statusFlags StatusFlags) (*RangeDownloadInfo, error) {
+	filename, dirName, err := statusDir(filename, statusFlags)
+	if err != nil {
+		return nil, err
 	}
 
-	var dirName string
-	if statusFlags.EnableTrace || statusFlags.EnableTelemetry {
-		dirName = filename[:(strings.LastIndex(filename, "."))]
-		err := os.MkdirAll(dirName, os.ModePerm)
-		if err != nil {
-			return nil, err
+	// pick up a previous attempt if its control file describes the same remote file
+	var file *os.File
+	state := loadResumeState(filename+controlFileExt, totalSize, validators)
+	if state != nil {
+		f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+		if err == nil {
+			stat, err := f.Stat()
+			if err == nil && stat.Size() == totalSize {
+				file = f
+			} else {
+				f.Close()
+			}
 		}
-		filename = filepath.Join(dirName, filename)
 	}
 
-	// pre-allocate file with TotalSize
-	file, err := os.Create(filename)
-	if err != nil {
-		return nil, err
-	}
+	if file == nil {
+		state = newResumeState(filename + controlFileExt)
 
-	err = file.Truncate(int64(totalSize))
-	if err != nil {
-		return nil, err
+		// pre-allocate file with TotalSize
+		f, err := os.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		err = f.Truncate(int64(totalSize))
+		if err != nil {
+			return nil, err
+		}
+		file = f
 	}
 
 	// create a WaitGroup and a Atomic Int64 Variable
 	var wg sync.WaitGroup
 	var bytesWritten atomic.Int64
-
-	workerSlice := make([]*WorkerInfo, workerLimit)
-	for i := range workerSlice {
-		workerInfo := &WorkerInfo{
-			ID:                i,
-			Status:            WorkerStatusIdle,
-			HttpClient:        newWorkerClient(),
-			RestartWorkerChan: make(chan struct{}, 1),
-		}
-		workerSlice[i] = workerInfo
-	}
-	workers := Workers{
-		Limit: workerLimit,
-		Slice: workerSlice,
+	if state.Resumed {
+		bytesWritten.Store(state.CompletedBytes())
 	}
 
 	// create a new pool for the Workers
@@ -152,110 +124,319 @@ func InitRangeDownloadInfo(filename string, totalSize int64, reqURl string, stat
 	}
 
 	rdi := &RangeDownloadInfo{
-		ChunkChan:           make(chan int),
-		WriterPool:          pool,
-		Wg:                  &wg,
-		Workers:             workers,
-		ChunkSize:           chunkSize,
-		TotalChunks:         int64(math.Ceil(float64(totalSize) / float64(chunkSize))),
-		TotalSize:           totalSize,
-		BytesWritten:        &bytesWritten,
-		ReqURL:              reqURl,
-		Filename:            filename,
-		DirName:             dirName,
-		File:                file,
-		StatusFlags:         statusFlags,
-		WorkerBaselineSpeed: 0,
+		WriterPool:   pool,
+		Wg:           &wg,
+		TotalSize:    totalSize,
+		BytesWritten: &bytesWritten,
+		ReqURL:       reqURl,
+		Filename:     filename,
+		DirName:      dirName,
+		File:         file,
+		StatusFlags:  statusFlags,
+		HealthPolicy: NewTrimmedMeanPolicy(),
+		Validators:   validators,
+		State:        state,
+		Mirrors:      NewMirrorSet([]*Mirror{{URL: reqURl, Validators: validators}}),
+		RetryPolicy:  DefaultRetryPolicy,
+		Timeouts:     DefaultTimeouts,
+		ErrorPolicy:  DefaultErrorPolicy,
+		Events:       NewEventBus(),
+		demand:       newDemand(),
 	}
+	rdi.SetWorkerLimit(workerLimit)
 
 	return rdi, nil
 }
 
-func (rdi *RangeDownloadInfo) RangeDownload(onDone DoneFunc, onVerify VerifyFunc, onError ErrorFunc) {
-	if rdi.TotalSize == 0 || rdi.Filename == "" {
-		onError(fmt.Errorf("Missing Information In the Provided Range Download Information"))
-		return
+// RangeDownload runs until the file is complete, fails or ctx is cancelled, in which case the workers
+// stop their requests and the partial file is either kept for resume or removed (DiscardPartial).
+// Everything that happens is published on rdi.Events, the last event is Completed or Failed
+func (rdi *RangeDownloadInfo) RangeDownload(ctx context.Context) (err error) {
+	// readers of the partial file waiting for bytes that will not come get the error
+	defer func() { rdi.demand.finish(err) }()
+
+	// the trace log and telemetry are subscribers like any other, they are flushed before returning
+	if rdi.StatusFlags.EnableTrace {
+		trace, err := newTraceLog(filepath.Join(rdi.DirName, "httptrace.log"))
+		if err != nil {
+			rdi.Events.publish(Failed{EventMeta: meta(-1, -1), Err: err})
+			return err
+		}
+		defer trace.close()
+		defer rdi.Events.Subscribe(trace)()
+	}
+	if rdi.StatusFlags.EnableTelemetry {
+		defer rdi.Events.Subscribe(newTelemetryRecorder(rdi.DirName, rdi.Snapshot))()
 	}
 
-	// spawn downloader go routines and wait for completion
-	rdi.Wg.Add(rdi.Workers.Limit)
-	for i := 0; i < rdi.Workers.Limit; i++ {
-		go rdi.rangeDownloadWorker(rdi.Workers.Slice[i], onError)
+	start := time.Now()
+	rdi.Events.publish(Started{
+		EventMeta: meta(-1, -1),
+		URL:       rdi.ReqURL,
+		Filename:  rdi.Filename,
+		TotalSize: rdi.TotalSize,
+		Resumed:   rdi.BytesWritten.Load(),
+		Workers:   rdi.Workers.Limit,
+	})
+	if err := rdi.rangeDownload(ctx); err != nil {
+		rdi.Events.publish(Failed{EventMeta: meta(-1, -1), Err: err})
+		return err
 	}
-	go func() {
-		for chunkIndex := 0; int64(chunkIndex) < rdi.TotalChunks; chunkIndex++ {
-			rdi.ChunkChan <- chunkIndex
+	rdi.Events.publish(Completed{EventMeta: meta(-1, -1), Bytes: rdi.BytesWritten.Load(), Elapsed: time.Since(start)})
+	return nil
+}
+
+func (rdi *RangeDownloadInfo) rangeDownload(ctx context.Context) error {
+	if rdi.TotalSize == 0 || rdi.Filename == "" {
+		return fmt.Errorf("Missing Information In the Provided Range Download Information")
+	}
+
+	var err error
+	for restarts := 0; ; restarts++ {
+		err = rdi.runWorkers(ctx)
+
+		var changed *RemoteChangedError
+		if !errors.As(err, &changed) {
+			break
 		}
-		close(rdi.ChunkChan)
-	}()
-	rdi.Wg.Wait()
+		// the bytes on disk belong to the old file, they are useless for resuming
+		if rdi.RestartOnChange && restarts < maxChangeRestarts && changed.TotalSize == rdi.TotalSize {
+			if resetErr := rdi.resetForRestart(ctx, changed); resetErr == nil {
+				continue
+			}
+		}
+		rdi.State.remove()
+		rdi.File.Close()
+		if changed.TotalSize != rdi.TotalSize && changed.TotalSize >= 0 {
+			return fmt.Errorf("%w (size changed from %d to %d bytes, re-run to download it again)", err, rdi.TotalSize, changed.TotalSize)
+		}
+		return err
+	}
 	rdi.File.Close()
 
+	if ctx.Err() != nil {
+		return rdi.cleanupPartial(ErrCancelled)
+	}
+	if err != nil {
+		return rdi.cleanupPartial(err)
+	}
+	if rdi.BytesWritten.Load() < rdi.TotalSize {
+		return rdi.cleanupPartial(errors.New("download incomplete"))
+	}
+	if err := rdi.State.remove(); err != nil {
+		return fmt.Errorf("could not remove control file - %w", err)
+	}
+
 	if rdi.Checksum != nil {
-		onVerify()
-		err := VerifyFile(rdi.Filename, rdi.Checksum.ExpectedHash, rdi.Checksum.Algo)
-		if err != nil {
-			onError(err)
-			return
+		rdi.Events.publish(VerifyStarted{EventMeta: meta(-1, -1), Algorithm: rdi.Checksum.AlgoName})
+		if err := VerifyFile(rdi.Filename, rdi.Checksum.ExpectedHash, rdi.Checksum.Algo); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	onDone()
+// cleanupPartial leaves an unfinished download in a defined state and says which one in the returned error
+func (rdi *RangeDownloadInfo) cleanupPartial(reason error) error {
+	if rdi.DiscardPartial {
+		rdi.State.remove()
+		if err := os.Remove(rdi.Filename); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%w\ncould not remove the partial file - %v", reason, err)
+		}
+		return fmt.Errorf("%w\npartial file removed", reason)
+	}
+	if err := rdi.State.save(rdi); err != nil {
+		return fmt.Errorf("%w\n%v", reason, err)
+	}
+	return fmt.Errorf("%w\n%d of %d bytes written, re-run to resume", reason, rdi.BytesWritten.Load(), rdi.TotalSize)
 }
 
-func (rdi *RangeDownloadInfo) rangeDownloadWorker(workerInfo *WorkerInfo, onError ErrorFunc) {
-	workerInfo.StartedAt = time.Now()
-	workerInfo.RestartedAt = time.Now()
-	defer rdi.Wg.Done()
+// runWorkers downloads every range that is not on disk yet, it returns the reason the download was aborted if it was
+func (rdi *RangeDownloadInfo) runWorkers(ctx context.Context) error {
+	rdi.ctx, rdi.cancel = context.WithCancelCause(ctx)
+
+	// ranges already on disk from a previous run are skipped
+	missing := rdi.State.missing(rdi.TotalSize)
+	rdi.sched = newScheduler(missing, rdi.ChunkSize)
+	rdi.sched.demand = rdi.demand
+	if rdi.Sequential {
+		rdi.sched.window = defaultSequentialWindow
+	}
+	rdi.demand.setWake(rdi.sched.expedite)
+	// workers waiting for work have to wake up when the download is cancelled
+	stopClose := context.AfterFunc(rdi.ctx, rdi.sched.close)
+	defer stopClose()
+	rdi.fetcher = newRangeFetcher(rdi.Mirrors, rdi.Header, rdi.TotalSize, rdi.RetryPolicy, rdi.Timeouts)
+	rdi.fetcher.events = rdi.Events
+	rdi.fetcher.onThrottle = func() {
+		// the pool shrinks as well
+		rdi.controller().throttled.Store(true)
+	}
+	rdi.failures = &failureLog{}
 
-	var logger *log.Logger
-	var logFile *os.File
+	// start with a few workers and let the controller grow the pool while it pays off
+	c := &concurrencyController{target: max(1, min(initialWorkers, rdi.Workers.Limit, int(missing.size()/minChunkSize)))}
+	rdi.poolMu.Lock()
+	rdi.concurrency = c
+	rdi.poolMu.Unlock()
+	rdi.Wg.Add(1)
+	rdi.setActiveWorkers(c.target)
+	go rdi.runConcurrencyController(c)
 
-	if rdi.StatusFlags.EnableTrace {
-		logger, logFile = rdi.getTraceLogger()
-		defer logFile.Close()
+	// persist progress periodically so a crash loses at most a second of bookkeeping
+	stopSaver := make(chan struct{})
+	go rdi.saveStatePeriodically(stopSaver)
+
+	rdi.Wg.Wait()
+	close(stopSaver)
+
+	err := context.Cause(rdi.ctx)
+	rdi.cancel(nil)
+	return err
+}
+
+// abort stops every worker, the cause is returned by runWorkers once they have all exited
+func (rdi *RangeDownloadInfo) abort(cause error) {
+	rdi.cancel(cause)
+	rdi.sched.close()
+}
+
+// resetForRestart throws away all progress so the download can start over against a new version of the
+// file, every mirror keeps its own validators for it and the ones that do not serve it are dropped
+func (rdi *RangeDownloadInfo) resetForRestart(ctx context.Context, changed *RemoteChangedError) error {
+	dropped, err := rdi.Mirrors.reprobe(ctx, changed, rdi.TotalSize, rdi.Header)
+	for _, e := range dropped {
+		rdi.Events.publish(e)
+	}
+	if err != nil {
+		return err
+	}
+	if err := rdi.File.Truncate(0); err != nil {
+		return err
+	}
+	if err := rdi.File.Truncate(rdi.TotalSize); err != nil {
+		return err
+	}
+
+	rdi.Validators = changed.New
+	rdi.State.reset()
+	rdi.BytesWritten.Store(0)
+	return nil
+}
+
+func (rdi *RangeDownloadInfo) saveStatePeriodically(stop chan struct{}) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rdi.State.save(rdi)
+		case <-stop:
+			return
+		}
 	}
+}
+
+func (rdi *RangeDownloadInfo) rangeDownloadWorker(workerInfo *WorkerInfo) {
+	workerInfo.started()
+	workerInfo.HttpClient = newWorkerClient(rdi.Timeouts)
+	defer rdi.Wg.Done()
+
+	for !workerInfo.retire.Load() {
+		// a worker waiting for work is not judged by the health monitor
+		workerInfo.setStatus(WorkerStatusIdle)
+		t, ok := rdi.sched.next(workerInfo, rdi.ActiveWorkers())
+		if !ok {
+			break
+		}
+		started := ChunkStarted{
+			EventMeta:  meta(workerInfo.ID, t.id),
+			Start:      t.start,
+			End:        t.limit() - 1,
+			StolenFrom: -1,
+			RacingWith: -1,
+		}
+		if t.stolenFrom != nil {
+			started.StolenFrom = t.stolenFrom.ID
+		} else if t.dupOf != nil {
+			started.RacingWith = t.dupOf.owner.ID
+		}
+		rdi.Events.publish(started)
 
-	for chunkIndex := range rdi.ChunkChan {
 		// check for a restart signal from health monitor
 		select {
 		case <-workerInfo.RestartWorkerChan:
-			workerInfo.HttpClient = newWorkerClient()
-			if rdi.StatusFlags.EnableTrace {
-				logger.Printf("[Worker %2d::Chunk %4d] RESTARTED | Worker Speed was: %s | Workers Baseline Speed: %s",
-					workerInfo.ID,
-					workerInfo.Chunk.Index,
-					utils.FormatSpeedString(workerInfo.Speed, "B/s"),
-					utils.FormatSpeedString(rdi.WorkerBaselineSpeed, "B/s"))
-			}
+			rdi.restartWorker(workerInfo)
 		default:
 		}
 
 		// if no signal from health monitor continue with downloading the chunk
-		err := workerInfo.downloadChunk(chunkIndex, rdi, logger)
+		err := workerInfo.downloadChunk(t, rdi)
+		if errors.Is(err, errRaceLost) {
+			// another worker wrote these bytes first, the connection itself was fine
+			rdi.Events.publish(RaceLost{EventMeta: meta(workerInfo.ID, t.id)})
+			rdi.sched.requeue(t)
+			continue
+		}
+		if errors.Is(err, errWorkerRestarted) {
+			// the in-flight request was aborted, hand the rest of the range back and reconnect
+			rdi.sched.requeue(t)
+			if rdi.ctx.Err() != nil {
+				break
+			}
+			select {
+			case <-workerInfo.RestartWorkerChan:
+			default:
+			}
+			rdi.restartWorker(workerInfo)
+			continue
+		}
+		if errors.Is(err, ErrRemoteChanged) {
+			rdi.sched.finish(t)
+			rdi.Events.publish(ChunkFailed{EventMeta: meta(workerInfo.ID, t.id), Start: t.start, End: t.limit() - 1, Err: err})
+			rdi.abort(err)
+			break
+		}
 		if err != nil {
-			onError(err)
+			// the range goes back for another try, the download only gives up once the error policy says so
+			end := t.limit() - 1
+			rdi.sched.requeue(t)
+			rdi.Events.publish(ChunkFailed{EventMeta: meta(workerInfo.ID, t.id), Start: t.start, End: end, Requeued: true, Err: err})
+			if fatal := rdi.failures.record(t.start, end, err, rdi.ErrorPolicy); fatal != nil {
+				rdi.abort(fatal)
+				break
+			}
+			continue
 		}
+		rdi.sched.finish(t)
+		rdi.Events.publish(ChunkCompleted{EventMeta: meta(workerInfo.ID, t.id), Start: t.start, End: t.limit() - 1})
 	}
 
-	workerInfo.Status = WorkerStatusDone
+	rdi.workerExited(workerInfo)
+}
+
+func (rdi *RangeDownloadInfo) restartWorker(workerInfo *WorkerInfo) {
+	workerInfo.HttpClient = newWorkerClient(rdi.Timeouts)
+	stats := workerInfo.Snapshot()
+	rdi.Events.publish(WorkerRestarted{
+		EventMeta: meta(workerInfo.ID, stats.Chunk.Index),
+		Speed:     stats.Speed,
+		Baseline:  rdi.baselineSpeed(),
+		Offset:    stats.Chunk.BytesDownloaded,
+	})
 }
 
 // <== Helper Functions ==>
-func GetFileName(u *url.URL, resp *http.Response) string {
-	contentDisposition := resp.Header.Get("Content-Disposition")
 
-	if contentDisposition != "" {
-		_, params, err := mime.ParseMediaType(contentDisposition)
-		if err == nil {
-			if fname, ok := params["filename"]; ok {
-				return fname
-			}
-			if fname, ok := params["filename*"]; ok {
-				return fname
-			}
-		}
+// statusDir moves filename into a directory of its own when the trace log or telemetry are written next to it
+func statusDir(filename string, statusFlags StatusFlags) (string, string, error) {
+	if filename == "" || !(statusFlags.EnableTrace || statusFlags.EnableTelemetry) {
+		return filename, "", nil
+	}
+	dirName := strings.TrimSuffix(filename, filepath.Ext(filename))
+	if err := os.MkdirAll(dirName, os.ModePerm); err != nil {
+		return "", "", err
 	}
-	pathSlice := strings.Split(u.Path, "/")
-	return pathSlice[len(pathSlice)-1]
+	return filepath.Join(dirName, filepath.Base(filename)), dirName, nil
 }
@@ -0,0 +1,249 @@
+package downloader
+
+import (
+	"sync"
+	"time"
+)
+
+// EventMeta is carried by every event, WorkerID and ChunkID are -1 when the event is not about one
+type EventMeta struct {
+	Time     time.Time
+	WorkerID int
+	ChunkID  int64
+}
+
+func (m EventMeta) Meta() EventMeta {
+	return m
+}
+
+// Event is one of the event types below, subscribers tell them apart with a type switch
+type Event interface {
+	Meta() EventMeta
+}
+
+// Started is the first event of a download, one that fails before it got going only sends Failed
+type Started struct {
+	EventMeta
+	URL       string
+	Filename  string
+	TotalSize int64 // -1 when the server did not say
+	Resumed   int64 // bytes already on disk from a previous run
+	Workers   int   // worker limit, 0 for a streamed download
+}
+
+// ChunkStarted is sent when a worker takes a byte range, split off or racing another worker's range if
+// StolenFrom or RacingWith is set (-1 otherwise)
+type ChunkStarted struct {
+	EventMeta
+	Start      int64
+	End        int64 // inclusive
+	StolenFrom int
+	RacingWith int
+}
+
+// ChunkCompleted is sent once every byte of the range is on disk
+type ChunkCompleted struct {
+	EventMeta
+	Start int64
+	End   int64 // inclusive
+}
+
+// ChunkFailed is sent when a range ran out of retries, it is handed back to the scheduler if Requeued
+type ChunkFailed struct {
+	EventMeta
+	Start    int64
+	End      int64 // inclusive
+	Requeued bool
+	Err      error
+}
+
+// RaceLost is sent by the slower worker of an endgame race, its request is dropped
+type RaceLost struct {
+	EventMeta
+}
+
+// Progress is sent whenever bytes are committed to the file
+type Progress struct {
+	EventMeta
+	Bytes int64 // new bytes
+	Total int64 // bytes written so far, including resumed ones
+}
+
+// Connected is sent when a worker's request got a connection
+type Connected struct {
+	EventMeta
+	Addr     string
+	Reused   bool
+	IdleTime time.Duration // how long a reused connection sat idle
+}
+
+// RetryScheduled is sent when a request failed and the worker tries again after Delay
+type RetryScheduled struct {
+	EventMeta
+	URL     string
+	Attempt int // the attempt that failed, starting at 1
+	Delay   time.Duration
+	Err     error
+}
+
+// MirrorDisabled is sent when a mirror answered with a status that makes asking it again pointless
+type MirrorDisabled struct {
+	EventMeta
+	URL string
+	Err error
+}
+
+// WorkerRestarted is sent when a worker reconnects on the health monitor's request
+type WorkerRestarted struct {
+	EventMeta
+	Speed    float64 // speed the worker was restarted at
+	Baseline float64
+	Offset   int64 // bytes of the chunk already on disk, the worker resumes there
+}
+
+// VerifyStarted is sent before the checksum of the finished file is computed
+type VerifyStarted struct {
+	EventMeta
+	Algorithm string
+}
+
+// Completed is the last event of a successful download
+type Completed struct {
+	EventMeta
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// Failed is the last event of a download that did not finish, Err wraps ErrCancelled if it was cancelled
+type Failed struct {
+	EventMeta
+	Err error
+}
+
+func meta(workerID int, chunkID int64) EventMeta {
+	return EventMeta{Time: time.Now(), WorkerID: workerID, ChunkID: chunkID}
+}
+
+// Subscriber receives the events of a download in the order they were published, on a goroutine of its own
+type Subscriber interface {
+	HandleEvent(e Event)
+}
+
+// SubscriberFunc lets an ordinary function be a Subscriber
+type SubscriberFunc func(e Event)
+
+func (f SubscriberFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// EventBus fans the events of a download out to its subscribers. Publishing never blocks, every
+// subscriber has its own queue so a slow one only falls behind and never holds up the workers
+type EventBus struct {
+	mu   sync.Mutex
+	subs []*subscription
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+type subscription struct {
+	subscriber Subscriber
+	mu         sync.Mutex
+	cond       *sync.Cond
+	queue      []Event
+	closed     bool
+	done       chan struct{}
+}
+
+// Subscribe starts delivering events to s, the returned func stops it once everything published
+// so far has been handled
+func (b *EventBus) Subscribe(s Subscriber) (unsubscribe func()) {
+	sub := &subscription{subscriber: s, done: make(chan struct{})}
+	sub.cond = sync.NewCond(&sub.mu)
+	go sub.run()
+
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			for i, other := range b.subs {
+				if other == sub {
+					b.subs = append(b.subs[:i], b.subs[i+1:]...)
+					break
+				}
+			}
+			b.mu.Unlock()
+			sub.close()
+		})
+	}
+}
+
+// Close delivers what is still queued and waits for every subscriber to handle it
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = nil
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+// publish is safe on a nil bus, downloads without subscribers simply have nobody to tell
+func (b *EventBus) publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sub := range b.subs {
+		sub.push(e)
+	}
+}
+
+func (sub *subscription) push(e Event) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.closed {
+		return
+	}
+	sub.queue = append(sub.queue, e)
+	sub.cond.Signal()
+}
+
+func (sub *subscription) close() {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.cond.Signal()
+	sub.mu.Unlock()
+	<-sub.done
+}
+
+func (sub *subscription) run() {
+	defer close(sub.done)
+	for {
+		sub.mu.Lock()
+		for len(sub.queue) == 0 && !sub.closed {
+			sub.cond.Wait()
+		}
+		events := sub.queue
+		sub.queue = nil
+		closed := sub.closed
+		sub.mu.Unlock()
+
+		for _, e := range events {
+			sub.subscriber.HandleEvent(e)
+		}
+		if closed && len(events) == 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package downloader
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventBusDeliversInOrder(t *testing.T) {
+	bus := NewEventBus()
+	var first, second []int64
+	bus.Subscribe(recorder(&first))
+	bus.Subscribe(recorder(&second))
+
+	want := publishProgress(bus, 0, 100)
+	bus.Close()
+
+	if !slices.Equal(first, want) || !slices.Equal(second, want) {
+		t.Errorf("subscribers saw %v and %v, want %v", first, second, want)
+	}
+}
+
+func TestEventBusSlowSubscriberDoesNotBlock(t *testing.T) {
+	bus := NewEventBus()
+	release := make(chan struct{})
+	var got []int64
+	bus.Subscribe(SubscriberFunc(func(e Event) {
+		<-release
+		got = append(got, e.(Progress).Total)
+	}))
+
+	published := make(chan []int64)
+	go func() { published <- publishProgress(bus, 0, 10) }()
+
+	var want []int64
+	select {
+	case want = <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a slow subscriber")
+	}
+	close(release)
+	bus.Close()
+
+	if !slices.Equal(got, want) {
+		t.Errorf("slow subscriber saw %v, want %v", got, want)
+	}
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := NewEventBus()
+	var kept, dropped []int64
+	bus.Subscribe(recorder(&kept))
+	unsubscribe := bus.Subscribe(recorder(&dropped))
+
+	before := publishProgress(bus, 0, 5)
+	unsubscribe()
+	unsubscribe() // a second call is harmless
+	after := publishProgress(bus, 5, 5)
+	bus.Close()
+
+	// everything published before unsubscribing is still handled, nothing after
+	if !slices.Equal(dropped, before) {
+		t.Errorf("unsubscribed subscriber saw %v, want %v", dropped, before)
+	}
+	if want := append(before, after...); !slices.Equal(kept, want) {
+		t.Errorf("remaining subscriber saw %v, want %v", kept, want)
+	}
+}
+
+func TestEventBusCloseFlushes(t *testing.T) {
+	bus := NewEventBus()
+	var mu sync.Mutex
+	handled := 0
+	bus.Subscribe(SubscriberFunc(func(e Event) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	}))
+
+	publishProgress(bus, 0, 20)
+	bus.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if handled != 20 {
+		t.Errorf("Close returned after %d of 20 events were handled", handled)
+	}
+
+	// publishing after Close reaches nobody, nor does publishing on a nil bus
+	bus.publish(Progress{})
+	var nilBus *EventBus
+	nilBus.publish(Progress{})
+}
+
+// <== Helper Functions ==>
+
+// recorder collects the Total of every Progress event, the bus calls it from one goroutine at a time
+func recorder(totals *[]int64) Subscriber {
+	return SubscriberFunc(func(e Event) {
+		*totals = append(*totals, e.(Progress).Total)
+	})
+}
+
+// publishProgress publishes n Progress events with totals counting up from from
+func publishProgress(bus *EventBus, from, n int64) []int64 {
+	var totals []int64
+	for total := from; total < from+n; total++ {
+		totals = append(totals, total)
+		bus.publish(Progress{EventMeta: meta(-1, -1), Bytes: 1, Total: total})
+	}
+	return totals
+}
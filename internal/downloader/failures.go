@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrorPolicy decides how many failed ranges a download tolerates before it gives up
+type ErrorPolicy struct {
+	MaxFailures int // ranges that ran out of retries and were put back for another try
+}
+
+var DefaultErrorPolicy = ErrorPolicy{
+	MaxFailures: 10,
+}
+
+// RangeFailure is a byte range that ran out of retries, possibly more than once
+type RangeFailure struct {
+	Start int64
+	End   int64 // inclusive
+	Count int
+	Err   error // last error
+}
+
+// DownloadError is returned once the error policy gives up, it lists every range that failed and why
+type DownloadError struct {
+	Failures []RangeFailure
+	Limit    int
+}
+
+func (e *DownloadError) Error() string {
+	total := 0
+	for _, f := range e.Failures {
+		total += f.Count
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "download failed, %d failed ranges (limit %d)", total, e.Limit)
+	for _, f := range e.Failures {
+		fmt.Fprintf(&sb, "\n  bytes %d-%d failed %d time(s): %v", f.Start, f.End, f.Count, f.Err)
+	}
+	return sb.String()
+}
+
+func (e *DownloadError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+type failureLog struct {
+	mu       sync.Mutex
+	total    int
+	failures []RangeFailure
+}
+
+// record adds a failed range and returns the aggregated error if the download has to give up,
+// that is when the policy's limit is exceeded or the error means no retry can ever succeed
+func (l *failureLog) record(start int64, end int64, err error, policy ErrorPolicy) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total++
+	found := false
+	for i := range l.failures {
+		if l.failures[i].Start == start && l.failures[i].End == end {
+			l.failures[i].Count++
+			l.failures[i].Err = err
+			found = true
+			break
+		}
+	}
+	if !found {
+		l.failures = append(l.failures, RangeFailure{Start: start, End: end, Count: 1, Err: err})
+	}
+
+	if l.total > policy.MaxFailures || errors.Is(err, ErrPermanent) || errors.Is(err, ErrRetryBudgetExhausted) {
+		return &DownloadError{
+			Failures: append([]RangeFailure(nil), l.failures...),
+			Limit:    policy.MaxFailures,
+		}
+	}
+	return nil
+}
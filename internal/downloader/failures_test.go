@@ -0,0 +1,168 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailureLogRecord(t *testing.T) {
+	errCut := errors.New("connection reset")
+	type failure struct {
+		start, end int64
+		err        error
+	}
+	tests := []struct {
+		name         string
+		maxFailures  int
+		failures     []failure
+		wantFatalAt  int // index of the failure that gives up, -1 if none does
+		wantFailures []RangeFailure
+	}{
+		{
+			name:         "up to the limit is tolerated",
+			maxFailures:  3,
+			failures:     []failure{{0, 9, errCut}, {10, 19, errCut}, {20, 29, errCut}},
+			wantFatalAt:  -1,
+			wantFailures: nil,
+		},
+		{
+			name:         "one past the limit gives up",
+			maxFailures:  2,
+			failures:     []failure{{0, 9, errCut}, {10, 19, errCut}, {20, 29, errCut}},
+			wantFatalAt:  2,
+			wantFailures: []RangeFailure{{0, 9, 1, errCut}, {10, 19, 1, errCut}, {20, 29, 1, errCut}},
+		},
+		{
+			name:         "the same range fails more than once",
+			maxFailures:  2,
+			failures:     []failure{{0, 9, errCut}, {10, 19, errCut}, {0, 9, ErrStalled}},
+			wantFatalAt:  2,
+			wantFailures: []RangeFailure{{0, 9, 2, ErrStalled}, {10, 19, 1, errCut}},
+		},
+		{
+			name:         "no failures allowed",
+			maxFailures:  0,
+			failures:     []failure{{0, 9, errCut}},
+			wantFatalAt:  0,
+			wantFailures: []RangeFailure{{0, 9, 1, errCut}},
+		},
+		{
+			name:         "a permanent error gives up below the limit",
+			maxFailures:  10,
+			failures:     []failure{{0, 9, errCut}, {10, 19, ErrPermanent}},
+			wantFatalAt:  1,
+			wantFailures: []RangeFailure{{0, 9, 1, errCut}, {10, 19, 1, ErrPermanent}},
+		},
+		{
+			name:         "an exhausted retry budget gives up below the limit",
+			maxFailures:  10,
+			failures:     []failure{{0, 9, ErrRetryBudgetExhausted}},
+			wantFatalAt:  0,
+			wantFailures: []RangeFailure{{0, 9, 1, ErrRetryBudgetExhausted}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log failureLog
+			policy := ErrorPolicy{MaxFailures: tt.maxFailures}
+			for i, f := range tt.failures {
+				err := log.record(f.start, f.end, f.err, policy)
+				if i != tt.wantFatalAt {
+					if err != nil {
+						t.Fatalf("failure %d gave up - %v", i, err)
+					}
+					continue
+				}
+
+				var downloadErr *DownloadError
+				if !errors.As(err, &downloadErr) {
+					t.Fatalf("failure %d returned %v, want a DownloadError", i, err)
+				}
+				if downloadErr.Limit != tt.maxFailures {
+					t.Errorf("limit %d, want %d", downloadErr.Limit, tt.maxFailures)
+				}
+				if fmt.Sprint(downloadErr.Failures) != fmt.Sprint(tt.wantFailures) {
+					t.Errorf("failures %v, want %v", downloadErr.Failures, tt.wantFailures)
+				}
+				if !errors.Is(err, f.err) {
+					t.Errorf("%v does not wrap the last error %v", err, f.err)
+				}
+				return
+			}
+		})
+	}
+}
+
+// a download tolerates MaxFailures failed ranges and gives up on the next one
+func TestErrorPolicyMaxFailures(t *testing.T) {
+	data := bytes.Repeat([]byte("downpour"), 256*1024) // 2MB
+	tests := []struct {
+		name     string
+		failures int64 // requests the server fails before serving, -1 fails them all
+		wantErr  bool
+	}{
+		{name: "failures within the limit", failures: 3},
+		{name: "failures past the limit", failures: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if n := requests.Add(1); tt.failures < 0 || n <= tt.failures {
+					http.Error(w, "try again", http.StatusInternalServerError)
+					return
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			filename := filepath.Join(t.TempDir(), "file.bin")
+			rdi, err := InitRangeDownloadInfo(filename, int64(len(data)), srv.URL, Validators{}, StatusFlags{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rdi.ChunkSize = 256 * 1024
+			rdi.SetWorkerLimit(4)
+			rdi.RetryPolicy = RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Budget: 100}
+			rdi.ErrorPolicy = ErrorPolicy{MaxFailures: 3}
+
+			err = rdi.RangeDownload(context.Background())
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("download failed - %v", err)
+				}
+				got, err := os.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Error("downloaded file differs from the served one")
+				}
+				return
+			}
+
+			var downloadErr *DownloadError
+			if !errors.As(err, &downloadErr) {
+				t.Fatalf("download returned %v, want a DownloadError", err)
+			}
+			total := 0
+			for _, f := range downloadErr.Failures {
+				total += f.Count
+			}
+			if total != 4 || downloadErr.Limit != 3 {
+				t.Errorf("gave up after %d failed ranges with limit %d, want 4 and 3", total, downloadErr.Limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// rangeFetcher is the request loop behind every range request: the workers of a RangeDownload, a
+// ParallelReader and a RemoteFile all pick mirrors, validate responses and retry through it
+type rangeFetcher struct {
+	mirrors     *MirrorSet
+	header      http.Header
+	totalSize   int64
+	retryPolicy RetryPolicy
+	timeouts    Timeouts
+	client      *http.Client
+	gate        *retryGate
+	events      *EventBus // Connected, MirrorDisabled and RetryScheduled go here, nil to publish nothing
+	onThrottle  func()    // called when a server answers 429/503, nil if nobody needs to know
+}
+
+func newRangeFetcher(mirrors *MirrorSet, header http.Header, totalSize int64, policy RetryPolicy, timeouts Timeouts) *rangeFetcher {
+	return &rangeFetcher{
+		mirrors:     mirrors,
+		header:      header,
+		totalSize:   totalSize,
+		retryPolicy: policy,
+		timeouts:    timeouts,
+		client:      newWorkerClient(timeouts),
+		gate:        newRetryGate(policy.Budget),
+	}
+}
+
+// rangeTarget is where the bytes of a validated response go
+type rangeTarget interface {
+	// missing returns the bytes [start, end) still to fetch, nothing is left once start >= end
+	missing() (int64, int64)
+	// copy reads the body of a response for the expected bytes from start on. errRangeStolen means the
+	// rest of the body is no longer needed and what was copied is complete
+	copy(body io.Reader, start int64, expected int64) (int64, error)
+	// commit keeps the first n bytes of the last copy, discard throws away what the copy did not commit
+	// on its way (a long response may commit in steps)
+	commit(n int64)
+	discard()
+}
+
+// rangeRequester is who the requests are made for, worker is nil when no worker reports on them
+type rangeRequester struct {
+	worker *WorkerInfo
+	chunk  int64
+}
+
+func (r rangeRequester) setStatus(status WorkerStatus) {
+	if r.worker != nil {
+		r.worker.setStatus(status)
+	}
+}
+
+func (r rangeRequester) meta() EventMeta {
+	if r.worker == nil {
+		return meta(-1, r.chunk)
+	}
+	return meta(r.worker.ID, r.chunk)
+}
+
+// do fills target through client, a broken response only costs the bytes that did not arrive. Once ctx is
+// cancelled it returns ctx.Err() or whatever error it had at hand, callers check ctx themselves
+func (f *rangeFetcher) do(ctx context.Context, client *http.Client, who rangeRequester, target rangeTarget) error {
+	policy := f.retryPolicy
+
+	for attempt := 0; ; attempt++ {
+		// wait out a pause requested by a throttling server before sending anything
+		if err := f.gate.wait(ctx); err != nil {
+			return err
+		}
+
+		// every attempt only asks for what is still missing, a task's end may have been stolen meanwhile
+		startPos, end := target.missing()
+		if startPos >= end {
+			return nil
+		}
+		endPos := end - 1
+
+		who.setStatus(WorkerStatusRequesting)
+		mirror, err := f.mirrors.pick()
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", mirror.URL, nil)
+		if err != nil {
+			f.mirrors.fail(mirror)
+			return err
+		}
+		setHeaders(req, f.header)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", startPos, endPos))
+
+		// ask the server to send the whole file instead of the range if it is not the file we started with
+		ifRange := ifRangeValue(mirror.Validators)
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+
+		if f.events != nil {
+			trace := &httptrace.ClientTrace{
+				GotConn: func(connInfo httptrace.GotConnInfo) {
+					f.events.publish(Connected{
+						EventMeta: who.meta(),
+						Addr:      connInfo.Conn.RemoteAddr().String(),
+						Reused:    connInfo.Reused,
+						IdleTime:  connInfo.IdleTime,
+					})
+				},
+			}
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		}
+
+		reqStart := time.Now()
+		resp, doErr := client.Do(req)
+
+		if doErr == nil {
+			if changeErr := detectChange(mirror.URL, mirror.Validators, resp, ifRange != ""); changeErr != nil {
+				resp.Body.Close()
+				f.mirrors.release(mirror, 0, 0)
+				return changeErr
+			}
+		}
+
+		var delay time.Duration
+		if doErr == nil && resp.StatusCode == http.StatusPartialContent {
+			if invalidErr := validateRangeResponse(resp, startPos, endPos, f.totalSize); invalidErr != nil {
+				resp.Body.Close()
+				doErr = invalidErr
+			} else {
+				// never read past the end of the requested range
+				who.setStatus(WorkerStatusDownloading)
+				expected := endPos - startPos + 1
+				body := newStallReader(resp.Body, f.timeouts.Stall)
+				n, copyErr := target.copy(body, startPos, expected)
+				if errors.Is(copyErr, errRangeStolen) {
+					// the rest of the response belongs to another worker now, what we have is all we need
+					copyErr = nil
+				} else if copyErr == nil {
+					// still watched, a server that holds the body open after the last byte must not hang us
+					copyErr = checkBodyLength(body, n, expected)
+				}
+				body.stop()
+				// closing a body that is not drained drops the connection, the price of a stolen range
+				resp.Body.Close()
+
+				switch {
+				case copyErr == nil:
+					target.commit(n)
+					f.mirrors.succeed(mirror, n, time.Since(reqStart))
+					f.gate.succeed()
+					return nil
+				case errors.Is(copyErr, ErrInvalidResponse):
+					// the body can not be trusted, nothing more is kept and the next attempt asks for the rest
+					target.discard()
+					doErr = copyErr
+				default:
+					// the connection broke but the headers were valid, so the bytes that arrived are kept
+					target.commit(n)
+					if ctx.Err() != nil {
+						f.mirrors.release(mirror, n, time.Since(reqStart))
+						return ctx.Err()
+					}
+					if stallErr := body.err(); stallErr != nil {
+						copyErr = stallErr
+					}
+					next, _ := target.missing()
+					doErr = fmt.Errorf("read failed after %d bytes, resuming at byte %d: %w", n, next, copyErr)
+				}
+			}
+		} else {
+			if ctx.Err() != nil {
+				f.mirrors.release(mirror, 0, 0)
+				return ctx.Err()
+			}
+
+			// close the response body if we received some other Reponse apart from StatusPartialContent
+			if resp != nil {
+				resp.Body.Close()
+
+				switch {
+				case permanentStatus[resp.StatusCode]:
+					// no point asking this mirror again, only give up if there is nowhere else to go
+					doErr = fmt.Errorf("%w: %s from %s", ErrPermanent, resp.Status, mirror.URL)
+					f.events.publish(MirrorDisabled{EventMeta: who.meta(), URL: mirror.URL, Err: doErr})
+					if !f.mirrors.disable(mirror) {
+						return fmt.Errorf("no usable mirror left - %w", doErr)
+					}
+					continue
+				case throttleStatus[resp.StatusCode]:
+					// everyone backs off, not just this request
+					if f.onThrottle != nil {
+						f.onThrottle()
+					}
+					delay = min(retryAfter(resp), policy.MaxDelay)
+					if delay == 0 {
+						delay = policy.backoff(attempt)
+					}
+					f.gate.pause(delay)
+				}
+				doErr = fmt.Errorf("bad status: %s", resp.Status)
+			}
+		}
+
+		// demote the mirror so the retry is likely to go somewhere else
+		f.mirrors.fail(mirror)
+
+		if attempt+1 >= policy.MaxRetries {
+			return fmt.Errorf("gave up after %d attempts - %w", policy.MaxRetries, doErr)
+		}
+		if !f.gate.spend() {
+			return fmt.Errorf("%w - last error: %v", ErrRetryBudgetExhausted, doErr)
+		}
+
+		who.setStatus(WorkerStatusRetrying)
+		delay = max(delay, policy.backoff(attempt))
+		f.events.publish(RetryScheduled{
+			EventMeta: who.meta(),
+			URL:       mirror.URL,
+			Attempt:   attempt + 1,
+			Delay:     delay,
+			Err:       doErr,
+		})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fetch fills p with the bytes starting at off through client. It returns how much of p is filled,
+// progress (if set) is told about every read
+func (f *rangeFetcher) fetch(ctx context.Context, client *http.Client, who rangeRequester, p []byte, off int64, progress func(n int64)) (int, error) {
+	b := &bufferTarget{p: p, off: off, progress: progress}
+	if err := f.do(ctx, client, who, b); err != nil {
+		return b.got, err
+	}
+	return len(p), nil
+}
+
+// <== Helper Functions ==>
+
+// bufferTarget is a rangeTarget in memory, p holds the bytes from off on
+type bufferTarget struct {
+	p        []byte
+	off      int64
+	got      int
+	progress func(n int64)
+}
+
+func (b *bufferTarget) missing() (int64, int64) {
+	return b.off + int64(b.got), b.off + int64(len(b.p))
+}
+
+func (b *bufferTarget) copy(body io.Reader, start int64, expected int64) (int64, error) {
+	n, err := io.ReadFull(&progressReader{r: body, progress: b.progress}, b.p[b.got:b.got+int(expected)])
+	return int64(n), err
+}
+
+func (b *bufferTarget) commit(n int64) {
+	b.got += int(n)
+}
+
+func (b *bufferTarget) discard() {}
+
+// progressReader reports every read of a response body
+type progressReader struct {
+	r        io.Reader
+	progress func(n int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.progress != nil {
+		p.progress(int64(n))
+	}
+	return n, err
+}
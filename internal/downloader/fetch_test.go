@@ -0,0 +1,54 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// a server that sends the requested bytes and then keeps the chunked body open must not hang the request
+func TestFetchStallAfterLastByte(t *testing.T) {
+	data := bytes.Repeat([]byte("downpour"), 1024)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start : end+1])
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	timeouts := DefaultTimeouts
+	timeouts.Stall = 100 * time.Millisecond
+	f := newRangeFetcher(NewMirrorSet([]*Mirror{{URL: srv.URL}}), nil, int64(len(data)), DefaultRetryPolicy, timeouts)
+
+	p := make([]byte, 100)
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.fetch(context.Background(), f.client, rangeRequester{}, p, 10, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("fetch failed - %v", err)
+		}
+		if !bytes.Equal(p, data[10:110]) {
+			t.Errorf("fetch returned the wrong bytes")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch hangs on a body that stays open after the requested bytes")
+	}
+}
@@ -2,77 +2,100 @@ package downloader
 
 import (
 	"context"
-	"sort"
 	"time"
 )
 
+// StartHealthMonitor samples worker speeds on every tick of the HealthPolicy and carries out what it decides
 func (rdi *RangeDownloadInfo) StartHealthMonitor(ctx context.Context) error {
-	ticker := time.NewTicker(1 * time.Second)
+	runHealthMonitor(ctx, rdi.HealthPolicy, rdi.Workers.Slice, rdi.Snapshot, func(decision HealthDecision) {
+		rdi.setBaselineSpeed(decision.Baseline)
+		rdi.applyHealthActions(decision.Actions)
+	})
+	return nil
+}
+
+// runHealthMonitor is the loop behind every health monitor, apply carries out the policy's decisions
+func runHealthMonitor(ctx context.Context, policy HealthPolicy, workers []*WorkerInfo, snapshot func() DownloadSnapshot, apply func(decision HealthDecision)) {
+	if policy == nil {
+		policy = NewTrimmedMeanPolicy()
+	}
+
+	ticker := time.NewTicker(policy.Interval())
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-
-			// copy current worker speeds
-			var workerSpeeds []float64
-			var activeWorkers []*WorkerInfo
-			var idleWorkers []*WorkerInfo
-			for _, wi := range rdi.Workers.Slice {
-				wi.UpdateSpeed()
-				if wi.Status == WorkerStatusDone {
-					idleWorkers = append(idleWorkers, wi)
-				} else {
-					activeWorkers = append(activeWorkers, wi)
-					workerSpeeds = append(workerSpeeds, wi.Speed)
-				}
-			}
-
-			if len(workerSpeeds) == 0 {
+			sampleSpeeds(workers)
+			s := healthSnapshot(snapshot())
+			if len(s.Workers) == 0 {
 				continue
 			}
+			apply(policy.Evaluate(s))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-			sort.Slice(workerSpeeds, func(i, j int) bool {
-				return workerSpeeds[i] > workerSpeeds[j]
-			})
+// sampleSpeeds updates the smoothed speed of every worker, the health monitor's tick is the clock for it
+func sampleSpeeds(workers []*WorkerInfo) {
+	for _, wi := range workers {
+		wi.updateSpeed()
+	}
+}
 
-			// find number of entries to trim for mean
-			trimCount := int(float64(len(workerSpeeds)) * 0.15)
-			if trimCount == 0 && rdi.Workers.Limit >= 4 {
-				// a small safeguard to make sure we drop atleast 1 value from both ends
-				trimCount = 1
-			}
+// healthSnapshot picks the workers with a task in flight out of a download snapshot, one waiting for work
+// has a speed that decays to 0 and would drag the baseline down and get restarted for nothing
+func healthSnapshot(s DownloadSnapshot) HealthSnapshot {
+	snapshot := HealthSnapshot{
+		BytesWritten:  s.BytesWritten,
+		TotalSize:     s.TotalSize,
+		ActiveWorkers: s.ActiveWorkers,
+		WorkerLimit:   s.WorkerLimit,
+	}
+	for _, w := range s.Workers {
+		if !w.Status.inFlight() {
+			continue
+		}
+		snapshot.Workers = append(snapshot.Workers, WorkerStats{
+			ID:           w.ID,
+			Speed:        w.Speed,
+			Status:       w.Status,
+			SinceRestart: time.Since(w.RestartedAt),
+		})
+	}
+	return snapshot
+}
 
-			// find trimmed mean
-			workerSpeedSummation := 0.0
-			validWorkers := 0
-			for i := trimCount; i < (len(workerSpeeds) - trimCount); i++ {
-				workerSpeedSummation += workerSpeeds[i]
-				validWorkers++
+func (rdi *RangeDownloadInfo) applyHealthActions(actions []HealthAction) {
+	for _, action := range actions {
+		switch action.Kind {
+		case ActionRestart:
+			if wi := rdi.worker(action.WorkerID); wi != nil {
+				wi.restart()
 			}
-			if validWorkers > 0 {
-				rdi.WorkerBaselineSpeed = workerSpeedSummation / float64(validWorkers)
-			} else {
-				// fallback if something weird happens
-				rdi.WorkerBaselineSpeed = workerSpeeds[len(workerSpeeds)/2]
+		case ActionRetire:
+			rdi.retireWorker(action.WorkerID)
+		case ActionThrottle:
+			if c := rdi.controller(); c != nil {
+				c.throttled.Store(true)
 			}
-
-			// find and restart workers that are slower and have not been recently restarted
-			if rdi.BytesWritten.Load() <= int64(0.98*float64(rdi.TotalSize)) {
-				for _, wi := range rdi.Workers.Slice {
-					if wi.Status != WorkerStatusDone && wi.Speed < (0.3*rdi.WorkerBaselineSpeed) && (time.Since(wi.RestartedAt) > 5*time.Second) {
-						wi.Status = WorkerStatusRestarting
-						signalRestart(wi.RestartWorkerChan)
-						wi.RestartedAt = time.Now()
-					}
-				}
+		case ActionSpawn:
+			if c := rdi.controller(); c != nil {
+				c.requested.Add(int64(max(action.Count, 1)))
 			}
-		case <-ctx.Done():
-			return nil
 		}
 	}
 }
 
+func (rdi *RangeDownloadInfo) worker(id int) *WorkerInfo {
+	if id < 0 || id >= len(rdi.Workers.Slice) {
+		return nil
+	}
+	return rdi.Workers.Slice[id]
+}
+
 // function to perform non-blocking send
 func signalRestart(ch chan struct{}) {
 	select {
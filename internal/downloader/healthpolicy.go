@@ -0,0 +1,245 @@
+package downloader
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WorkerStats is what a HealthPolicy sees of one busy worker
+type WorkerStats struct {
+	ID           int
+	Speed        float64 // smoothed, bytes per second
+	Status       WorkerStatus
+	SinceRestart time.Duration // since the worker started or was last restarted
+}
+
+// HealthSnapshot is handed to the HealthPolicy on every tick
+type HealthSnapshot struct {
+	Workers       []WorkerStats // running workers that are not idle, never empty
+	BytesWritten  int64
+	TotalSize     int64
+	ActiveWorkers int
+	WorkerLimit   int
+}
+
+type HealthActionKind int
+
+const (
+	ActionRestart  HealthActionKind = iota // reconnect the worker, its chunk is re-queued
+	ActionRetire                           // stop the worker once its chunk is done
+	ActionThrottle                         // halve the worker pool, as if the server had answered 429
+	ActionSpawn                            // grow the worker pool by Count
+)
+
+type HealthAction struct {
+	Kind     HealthActionKind
+	WorkerID int // restart and retire
+	Count    int // spawn
+}
+
+// HealthDecision is what a HealthPolicy wants done after looking at a snapshot
+type HealthDecision struct {
+	Baseline float64 // speed a healthy worker is expected to reach, shown in the UI and trace log
+	Actions  []HealthAction
+}
+
+// HealthPolicy decides which workers the health monitor acts on
+type HealthPolicy interface {
+	Name() string
+	Interval() time.Duration
+	Evaluate(s HealthSnapshot) HealthDecision
+}
+
+// HealthConfig holds the knobs every built-in policy shares
+type HealthConfig struct {
+	Tick      time.Duration // how often the monitor runs
+	Grace     time.Duration // a (re)started worker is left alone this long, TCP slow-start needs time
+	Threshold float64       // workers slower than Threshold x baseline are restarted
+	Cutoff    float64       // no restarts once this fraction of the file is written
+}
+
+var DefaultHealthConfig = HealthConfig{
+	Tick:      1 * time.Second,
+	Grace:     5 * time.Second,
+	Threshold: 0.3,
+	Cutoff:    0.98,
+}
+
+func (c HealthConfig) Interval() time.Duration {
+	return c.Tick
+}
+
+// restartBelow restarts every worker slower than limit that is past its grace period
+func (c HealthConfig) restartBelow(s HealthSnapshot, limit float64) []HealthAction {
+	if s.BytesWritten > int64(c.Cutoff*float64(s.TotalSize)) {
+		return nil
+	}
+	var actions []HealthAction
+	for _, w := range s.Workers {
+		if w.Speed < limit && w.SinceRestart > c.Grace {
+			actions = append(actions, HealthAction{Kind: ActionRestart, WorkerID: w.ID})
+		}
+	}
+	return actions
+}
+
+// TrimmedMeanPolicy restarts workers slower than Threshold x the mean speed with the fastest and
+// slowest Trim fraction left out, this is the default
+type TrimmedMeanPolicy struct {
+	HealthConfig
+	Trim float64
+}
+
+func NewTrimmedMeanPolicy() *TrimmedMeanPolicy {
+	return &TrimmedMeanPolicy{HealthConfig: DefaultHealthConfig, Trim: 0.15}
+}
+
+func (p *TrimmedMeanPolicy) Name() string {
+	return "trimmed-mean"
+}
+
+func (p *TrimmedMeanPolicy) Evaluate(s HealthSnapshot) HealthDecision {
+	workerSpeeds := sortedSpeeds(s)
+
+	// find number of entries to trim for mean
+	trimCount := int(float64(len(workerSpeeds)) * p.Trim)
+	if trimCount == 0 && s.WorkerLimit >= 4 {
+		// a small safeguard to make sure we drop atleast 1 value from both ends
+		trimCount = 1
+	}
+
+	// find trimmed mean
+	workerSpeedSummation := 0.0
+	validWorkers := 0
+	for i := trimCount; i < (len(workerSpeeds) - trimCount); i++ {
+		workerSpeedSummation += workerSpeeds[i]
+		validWorkers++
+	}
+	var baseline float64
+	if validWorkers > 0 {
+		baseline = workerSpeedSummation / float64(validWorkers)
+	} else {
+		// fallback if something weird happens
+		baseline = workerSpeeds[len(workerSpeeds)/2]
+	}
+
+	return HealthDecision{
+		Baseline: baseline,
+		Actions:  p.restartBelow(s, p.Threshold*baseline),
+	}
+}
+
+// MedianMADPolicy treats a worker as an outlier when it is more than K median absolute deviations
+// below the median speed, and also slower than Threshold x the median
+type MedianMADPolicy struct {
+	HealthConfig
+	K float64
+}
+
+func NewMedianMADPolicy() *MedianMADPolicy {
+	return &MedianMADPolicy{HealthConfig: DefaultHealthConfig, K: 3}
+}
+
+func (p *MedianMADPolicy) Name() string {
+	return "mad"
+}
+
+func (p *MedianMADPolicy) Evaluate(s HealthSnapshot) HealthDecision {
+	speeds := sortedSpeeds(s)
+	median := percentile(speeds, 0.5)
+
+	deviations := make([]float64, len(speeds))
+	for i, speed := range speeds {
+		deviations[i] = math.Abs(speed - median)
+	}
+	sort.Float64s(deviations)
+	// 1.4826 scales the MAD to a standard deviation for normally distributed speeds
+	mad := 1.4826 * percentile(deviations, 0.5)
+
+	limit := min(median-p.K*mad, p.Threshold*median)
+	return HealthDecision{
+		Baseline: median,
+		Actions:  p.restartBelow(s, limit),
+	}
+}
+
+// PercentilePolicy restarts workers in the slowest Percentile of the pool, as long as they are
+// also slower than Threshold x the median so a healthy pool is left alone
+type PercentilePolicy struct {
+	HealthConfig
+	Percentile float64
+}
+
+func NewPercentilePolicy() *PercentilePolicy {
+	return &PercentilePolicy{HealthConfig: DefaultHealthConfig, Percentile: 0.1}
+}
+
+func (p *PercentilePolicy) Name() string {
+	return "percentile"
+}
+
+func (p *PercentilePolicy) Evaluate(s HealthSnapshot) HealthDecision {
+	speeds := sortedSpeeds(s)
+	median := percentile(speeds, 0.5)
+
+	limit := min(percentile(speeds, p.Percentile), p.Threshold*median)
+	// the slowest worker sits on the percentile when the pool is small, so compare inclusively
+	limit = math.Nextafter(limit, math.Inf(1))
+	return HealthDecision{
+		Baseline: median,
+		Actions:  p.restartBelow(s, limit),
+	}
+}
+
+// healthPolicies maps the names accepted on the command line to their constructors
+var healthPolicies = map[string]func() HealthPolicy{
+	"trimmed-mean": func() HealthPolicy { return NewTrimmedMeanPolicy() },
+	"mad":          func() HealthPolicy { return NewMedianMADPolicy() },
+	"percentile":   func() HealthPolicy { return NewPercentilePolicy() },
+}
+
+// HealthPolicyNames lists the built-in policies
+func HealthPolicyNames() []string {
+	names := make([]string, 0, len(healthPolicies))
+	for name := range healthPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HealthPolicyByName returns a built-in policy with its default settings
+func HealthPolicyByName(name string) (HealthPolicy, error) {
+	newPolicy, ok := healthPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown health policy %q, expected one of %s", name, strings.Join(HealthPolicyNames(), ", "))
+	}
+	return newPolicy(), nil
+}
+
+// <== Helper Functions ==>
+func sortedSpeeds(s HealthSnapshot) []float64 {
+	speeds := make([]float64, len(s.Workers))
+	for i, w := range s.Workers {
+		speeds[i] = w.Speed
+	}
+	sort.Float64s(speeds)
+	return speeds
+}
+
+// percentile of an ascending slice, linearly interpolated
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := p * float64(len(sorted)-1)
+	lower := int(pos)
+	if lower+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	frac := pos - float64(lower)
+	return sorted[lower] + frac*(sorted[lower+1]-sorted[lower])
+}
@@ -0,0 +1,136 @@
+package downloader
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTrimmedMeanPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		limit        int
+		speeds       []float64
+		fresh        []int // workers still in their grace period
+		written      int64 // of 100 bytes
+		wantBaseline float64
+		wantRestart  []int
+	}{
+		{"healthy pool", 4, []float64{10, 10, 10, 10}, nil, 0, 10, nil},
+		{"one slow worker", 8, []float64{1, 10, 10, 10, 10}, nil, 0, 10, []int{0}},
+		{"slow worker in its grace period", 8, []float64{1, 10, 10, 10, 10}, []int{0}, 0, 10, nil},
+		{"past the cutoff", 8, []float64{1, 10, 10, 10, 10}, nil, 99, 10, nil},
+		{"small pool keeps every speed", 2, []float64{1, 10}, nil, 0, 5.5, []int{0}},
+		{"few busy workers of a large pool", 8, []float64{1, 10}, nil, 0, 10, []int{0}},
+		{"three busy workers of a large pool", 8, []float64{12, 2, 10}, nil, 0, 10, []int{1}},
+		{"fifteen percent trimmed", 32, []float64{1, 2, 3, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 100, 200, 300}, nil, 0, 10, []int{0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewTrimmedMeanPolicy().Evaluate(healthSnap(tt.limit, tt.speeds, tt.fresh, tt.written))
+			checkDecision(t, d, tt.wantBaseline, tt.wantRestart)
+		})
+	}
+}
+
+func TestMedianMADPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		speeds       []float64
+		wantBaseline float64
+		wantRestart  []int
+	}{
+		{"healthy pool", []float64{10, 10, 10, 10}, 10, nil},
+		{"one slow worker in a tight pool", []float64{10, 10, 1, 10, 10}, 10, []int{2}},
+		{"normal spread", []float64{8, 9, 10, 11, 12}, 10, nil},
+		{"outlier below the threshold", []float64{2.5, 9, 10, 11, 12}, 10, []int{0}},
+		{"wide spread leaves the slowest alone", []float64{1, 3, 5, 7, 9}, 5, nil},
+		{"single worker", []float64{1}, 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewMedianMADPolicy().Evaluate(healthSnap(8, tt.speeds, nil, 0))
+			checkDecision(t, d, tt.wantBaseline, tt.wantRestart)
+		})
+	}
+}
+
+func TestPercentilePolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		speeds       []float64
+		wantBaseline float64
+		wantRestart  []int
+	}{
+		{"healthy pool", []float64{10, 10, 10, 10}, 10, nil},
+		{"slowest far below the median", []float64{10, 1, 10, 10, 10}, 10, []int{1}},
+		{"slowest not below the threshold", []float64{5, 10, 10, 10, 10}, 10, nil},
+		{"slowest right on the threshold", []float64{3, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10}, 10, []int{0}},
+		{"single worker", []float64{1}, 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewPercentilePolicy().Evaluate(healthSnap(8, tt.speeds, nil, 0))
+			checkDecision(t, d, tt.wantBaseline, tt.wantRestart)
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 0.5, 0},
+		{[]float64{5}, 0.1, 5},
+		{[]float64{1, 2, 3, 4}, 0, 1},
+		{[]float64{1, 2, 3, 4}, 0.5, 2.5},
+		{[]float64{1, 2, 3, 4}, 1, 4},
+		{[]float64{1, 2, 3, 4}, 0.1, 1.3},
+		{[]float64{1, 2, 3}, 0.5, 2},
+	}
+
+	for _, tt := range tests {
+		if got := percentile(tt.sorted, tt.p); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("percentile(%v, %v) = %v, want %v", tt.sorted, tt.p, got, tt.want)
+		}
+	}
+}
+
+// <== Helper Functions ==>
+
+// healthSnap builds a snapshot of busy workers with the given speeds, IDs are their index
+func healthSnap(limit int, speeds []float64, fresh []int, written int64) HealthSnapshot {
+	s := HealthSnapshot{BytesWritten: written, TotalSize: 100, ActiveWorkers: len(speeds), WorkerLimit: limit}
+	for i, speed := range speeds {
+		since := time.Minute
+		if slices.Contains(fresh, i) {
+			since = time.Second
+		}
+		s.Workers = append(s.Workers, WorkerStats{ID: i, Speed: speed, Status: WorkerStatusDownloading, SinceRestart: since})
+	}
+	return s
+}
+
+func checkDecision(t *testing.T, d HealthDecision, wantBaseline float64, wantRestart []int) {
+	t.Helper()
+	if math.Abs(d.Baseline-wantBaseline) > 1e-9 {
+		t.Errorf("baseline = %v, want %v", d.Baseline, wantBaseline)
+	}
+	var restarted []int
+	for _, a := range d.Actions {
+		if a.Kind != ActionRestart {
+			t.Errorf("unexpected action %v", a)
+			continue
+		}
+		restarted = append(restarted, a.WorkerID)
+	}
+	if !slices.Equal(restarted, wantRestart) {
+		t.Errorf("restarted workers %v, want %v", restarted, wantRestart)
+	}
+}
@@ -0,0 +1,227 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const maxMirrorFailures = 5
+const mirrorDemotionTime = 10 * time.Second
+
+type Mirror struct {
+	URL          string
+	Validators   Validators
+	Speed        float64 // smoothened per-connection throughput in B/s
+	Active       int
+	Failures     int // consecutive failures, reset on success
+	DemotedUntil time.Time
+	Disabled     bool
+}
+
+// MirrorSet hands out mirrors to workers, favouring the ones that are currently fastest
+type MirrorSet struct {
+	mu   sync.Mutex
+	List []*Mirror
+}
+
+func NewMirrorSet(mirrors []*Mirror) *MirrorSet {
+	return &MirrorSet{List: mirrors}
+}
+
+// pick chooses a mirror at random weighted by its speed so load is spread proportionally,
+// mirrors that have not been measured yet get the best weight so they are sampled early
+func (ms *MirrorSet) pick() (*Mirror, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	var candidates []*Mirror
+	var demoted *Mirror
+	bestSpeed := 0.0
+	for _, m := range ms.List {
+		if m.Disabled {
+			continue
+		}
+		if now.Before(m.DemotedUntil) {
+			if demoted == nil || m.DemotedUntil.Before(demoted.DemotedUntil) {
+				demoted = m
+			}
+			continue
+		}
+		candidates = append(candidates, m)
+		bestSpeed = max(bestSpeed, m.Speed)
+	}
+
+	if len(candidates) == 0 {
+		// every usable mirror is demoted, fall back to the one that recovers first
+		if demoted == nil {
+			return nil, fmt.Errorf("%w: all %d mirrors failed", ErrPermanent, len(ms.List))
+		}
+		demoted.Active++
+		return demoted, nil
+	}
+
+	if bestSpeed == 0 {
+		bestSpeed = 1
+	}
+	weights := make([]float64, len(candidates))
+	totalWeight := 0.0
+	for i, m := range candidates {
+		weights[i] = m.Speed
+		if m.Speed == 0 {
+			weights[i] = bestSpeed
+		}
+		totalWeight += weights[i]
+	}
+
+	choice := rand.Float64() * totalWeight
+	picked := candidates[len(candidates)-1]
+	for i, m := range candidates {
+		if choice < weights[i] {
+			picked = m
+			break
+		}
+		choice -= weights[i]
+	}
+	picked.Active++
+	return picked, nil
+}
+
+// succeed records a finished transfer of n bytes from the mirror
+func (ms *MirrorSet) succeed(m *Mirror, n int64, elapsed time.Duration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	m.Active--
+	m.Failures = 0
+	m.updateSpeed(n, elapsed)
+}
+
+// release gives the mirror back without judging it, used when a request was aborted on our side,
+// whatever was transferred until then still counts towards the mirror's speed
+func (ms *MirrorSet) release(m *Mirror, n int64, elapsed time.Duration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	m.Active--
+	m.updateSpeed(n, elapsed)
+}
+
+// caller must hold the lock
+func (m *Mirror) updateSpeed(n int64, elapsed time.Duration) {
+	if elapsed <= 0 || n == 0 {
+		return
+	}
+	curSpeed := float64(n) / elapsed.Seconds()
+	if m.Speed == 0 {
+		m.Speed = curSpeed
+	} else {
+		m.Speed = (0.7 * m.Speed) + (0.3 * curSpeed)
+	}
+}
+
+// fail demotes the mirror for a while and disables it after too many consecutive failures
+func (ms *MirrorSet) fail(m *Mirror) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	m.Active--
+	m.Failures++
+	m.DemotedUntil = time.Now().Add(mirrorDemotionTime)
+	if m.Failures >= maxMirrorFailures && ms.usable() > 1 {
+		m.Disabled = true
+	}
+}
+
+// disable takes the mirror out of rotation for good, it returns false if no usable mirror is left
+func (ms *MirrorSet) disable(m *Mirror) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	m.Active--
+	m.Disabled = true
+	return ms.usable() > 0
+}
+
+// number of mirrors that have not been disabled, caller must hold the lock
+func (ms *MirrorSet) usable() int {
+	count := 0
+	for _, m := range ms.List {
+		if !m.Disabled {
+			count++
+		}
+	}
+	return count
+}
+
+// reprobe asks every mirror for its own validators once the file changed on the mirror at changed.URL.
+// Mirrors that do not serve the new version (yet) are disabled and returned as the events to publish, err
+// is set when no mirror is left
+func (ms *MirrorSet) reprobe(ctx context.Context, changed *RemoteChangedError, totalSize int64, header http.Header) (dropped []MirrorDisabled, err error) {
+	ms.mu.Lock()
+	list := make([]*Mirror, 0, len(ms.List))
+	for _, m := range ms.List {
+		if !m.Disabled {
+			list = append(list, m)
+		}
+	}
+	ms.mu.Unlock()
+
+	// probed without the lock, nothing else uses the set while the download restarts
+	validators := make([]Validators, len(list))
+	reasons := make([]error, len(list))
+	for i, m := range list {
+		if m.URL == changed.URL {
+			validators[i] = changed.New
+			continue
+		}
+		probe, probeErr := Probe(ctx, m.URL, header)
+		switch {
+		case probeErr != nil:
+			reasons[i] = fmt.Errorf("not reachable after the file changed - %w", probeErr)
+		case !probe.AcceptRange:
+			reasons[i] = errors.New("range requests are not supported after the file changed")
+		case probe.TotalSize != totalSize:
+			reasons[i] = fmt.Errorf("reports a size of %d bytes after the file changed, expected %d", probe.TotalSize, totalSize)
+		case changed.New.ETag != "" && probe.Validators.ETag != "" && probe.Validators.ETag != changed.New.ETag:
+			reasons[i] = fmt.Errorf("reports ETag %s after the file changed, expected %s", probe.Validators.ETag, changed.New.ETag)
+		default:
+			validators[i] = probe.Validators
+		}
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for i, m := range list {
+		if reasons[i] != nil {
+			m.Disabled = true
+			dropped = append(dropped, MirrorDisabled{EventMeta: meta(-1, -1), URL: m.URL, Err: reasons[i]})
+			continue
+		}
+		m.Validators = validators[i]
+		m.Failures = 0
+		m.DemotedUntil = time.Time{}
+	}
+	if ms.usable() == 0 {
+		return dropped, fmt.Errorf("%w: no mirror serves the new version of the file", ErrPermanent)
+	}
+	return dropped, nil
+}
+
+// Snapshot returns a copy of the mirror list for display
+func (ms *MirrorSet) Snapshot() []Mirror {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	mirrors := make([]Mirror, len(ms.List))
+	for i, m := range ms.List {
+		mirrors[i] = *m
+	}
+	return mirrors
+}
@@ -0,0 +1,326 @@
+package downloader
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultStreamChunkSize = 4 * 1024 * 1024 // 4MB
+
+// ParallelReader downloads a file with several workers ahead of the reader and hands the bytes back
+// strictly in order. Workers never run more than BufferSize ahead of the reader, which caps the memory
+// it uses, and the HealthPolicy restarts slow workers just like it does for RangeDownload.
+// The exported fields can be changed until Start
+type ParallelReader struct {
+	URL          string
+	TotalSize    int64
+	Mirrors      *MirrorSet
+	Header       http.Header
+	RetryPolicy  RetryPolicy
+	Timeouts     Timeouts
+	HealthPolicy HealthPolicy
+	Checksum     *ChecksumInfo // hashed as the bytes are read, the last Read fails on a mismatch
+	Workers      int
+	ChunkSize    int64             // bytes per request
+	BufferSize   int64             // most bytes fetched ahead of the reader, 2 chunks per worker when 0
+	Transport    http.RoundTripper // shared by the workers instead of a connection pool each when set
+	Events       *EventBus
+
+	workers []*WorkerInfo
+	fetcher *rangeFetcher
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	wg      sync.WaitGroup
+	start   time.Time
+	window  int64        // chunks that may be in memory at once
+	fetched atomic.Int64 // bytes fetched so far, read or not
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	chunks   map[int64]*streamChunk // handed to a worker and not read yet
+	next     int64                  // next chunk to hand out
+	readIdx  int64                  // chunk the reader is in
+	readOff  int64                  // position of the reader in that chunk
+	hash     hash.Hash
+	err      error // why reading stopped, io.EOF once everything was read
+	baseline float64
+}
+
+type streamChunk struct {
+	data []byte
+	done bool
+}
+
+func NewParallelReader(reqURL string, totalSize int64, validators Validators) *ParallelReader {
+	return &ParallelReader{
+		URL:          reqURL,
+		TotalSize:    totalSize,
+		Mirrors:      NewMirrorSet([]*Mirror{{URL: reqURL, Validators: validators}}),
+		RetryPolicy:  DefaultRetryPolicy,
+		Timeouts:     DefaultTimeouts,
+		HealthPolicy: NewTrimmedMeanPolicy(),
+		Workers:      defaultRemoteWorkers,
+		ChunkSize:    defaultStreamChunkSize,
+		Events:       NewEventBus(),
+	}
+}
+
+// Start launches the workers, cancelling ctx stops them and makes Read fail with ErrCancelled
+func (pr *ParallelReader) Start(ctx context.Context) {
+	pr.ChunkSize = max(pr.ChunkSize, minChunkSize)
+	if pr.BufferSize <= 0 {
+		pr.BufferSize = 2 * int64(max(pr.Workers, 1)) * pr.ChunkSize
+	}
+	pr.window = max(pr.BufferSize/pr.ChunkSize, 1)
+	pr.fetcher = newRangeFetcher(pr.Mirrors, pr.Header, pr.TotalSize, pr.RetryPolicy, pr.Timeouts)
+	pr.fetcher.events = pr.Events
+	pr.ctx, pr.cancel = context.WithCancelCause(ctx)
+	pr.cond = sync.NewCond(&pr.mu)
+	pr.chunks = make(map[int64]*streamChunk)
+	if pr.Checksum != nil {
+		pr.hash = pr.Checksum.Algo.NewHash()
+	}
+	pr.workers = make([]*WorkerInfo, max(pr.Workers, 1))
+	for i := range pr.workers {
+		pr.workers[i] = newWorkerInfo(i)
+	}
+
+	pr.start = time.Now()
+	pr.Events.publish(Started{EventMeta: meta(-1, -1), URL: pr.URL, TotalSize: pr.TotalSize, Workers: len(pr.workers)})
+
+	// a reader waiting for a chunk has to wake up when the download is cancelled
+	context.AfterFunc(pr.ctx, func() {
+		pr.mu.Lock()
+		defer pr.mu.Unlock()
+		pr.stop(ErrCancelled)
+	})
+
+	for _, wi := range pr.workers {
+		pr.wg.Add(1)
+		go pr.worker(wi)
+	}
+	go runHealthMonitor(pr.ctx, pr.HealthPolicy, pr.workers, pr.Snapshot, func(decision HealthDecision) {
+		pr.mu.Lock()
+		pr.baseline = decision.Baseline
+		pr.mu.Unlock()
+		// the pool is fixed, so restarts are the only action that applies
+		for _, action := range decision.Actions {
+			if action.Kind == ActionRestart && action.WorkerID >= 0 && action.WorkerID < len(pr.workers) {
+				pr.workers[action.WorkerID].restart()
+			}
+		}
+	})
+}
+
+// Read blocks until the next bytes of the file are fetched
+func (pr *ParallelReader) Read(p []byte) (int, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	for {
+		if pr.err != nil {
+			return 0, pr.err
+		}
+		if pr.readIdx*pr.ChunkSize+pr.readOff >= pr.TotalSize {
+			pr.finish()
+			continue
+		}
+		c := pr.chunks[pr.readIdx]
+		if c != nil && c.done {
+			n := copy(p, c.data[pr.readOff:])
+			if pr.hash != nil {
+				pr.hash.Write(p[:n])
+			}
+			pr.readOff += int64(n)
+			if pr.readOff == int64(len(c.data)) {
+				// the chunk is handed back, which makes room for one more ahead of the reader
+				delete(pr.chunks, pr.readIdx)
+				pr.readIdx++
+				pr.readOff = 0
+				pr.cond.Broadcast()
+			}
+			return n, nil
+		}
+		pr.cond.Wait()
+	}
+}
+
+// Close stops the workers, a reader that did not get to the end reports it as cancelled
+func (pr *ParallelReader) Close() error {
+	return pr.CloseWithError(nil)
+}
+
+// CloseWithError stops the workers, err (ErrCancelled when nil) is what the download failed with if
+// the reader did not get to the end
+func (pr *ParallelReader) CloseWithError(err error) error {
+	if pr.cancel == nil {
+		return nil
+	}
+	if err == nil {
+		err = ErrCancelled
+	}
+	pr.mu.Lock()
+	pr.stop(err)
+	pr.mu.Unlock()
+	pr.wg.Wait()
+	return nil
+}
+
+// Snapshot returns a consistent copy of the statistics of every worker
+func (pr *ParallelReader) Snapshot() DownloadSnapshot {
+	s := DownloadSnapshot{
+		BytesWritten:  pr.fetched.Load(),
+		TotalSize:     pr.TotalSize,
+		ActiveWorkers: len(pr.workers),
+		WorkerLimit:   len(pr.workers),
+		Mirrors:       pr.Mirrors.Snapshot(),
+	}
+	for _, wi := range pr.workers {
+		s.Workers = append(s.Workers, wi.Snapshot())
+	}
+	pr.mu.Lock()
+	s.BaselineSpeed = pr.baseline
+	pr.mu.Unlock()
+	return s
+}
+
+// <== Helper Functions ==>
+
+// stop ends the download with err, the first reason wins. Caller must hold the lock
+func (pr *ParallelReader) stop(err error) {
+	if pr.err != nil {
+		return
+	}
+	pr.err = err
+	if err != io.EOF {
+		pr.Events.publish(Failed{EventMeta: meta(-1, -1), Err: err})
+	}
+	pr.cancel(err)
+	pr.cond.Broadcast()
+}
+
+// finish runs once the reader got every byte, caller must hold the lock
+func (pr *ParallelReader) finish() {
+	if pr.hash != nil {
+		if sum := hex.EncodeToString(pr.hash.Sum(nil)); sum != pr.Checksum.ExpectedHash {
+			pr.stop(fmt.Errorf("checksum mismatch: expected %s | got %s", pr.Checksum.ExpectedHash, sum))
+			return
+		}
+	}
+	pr.Events.publish(Completed{EventMeta: meta(-1, -1), Bytes: pr.TotalSize, Elapsed: time.Since(pr.start)})
+	pr.stop(io.EOF)
+}
+
+// take hands out the next chunk once there is room for it in the buffer, it returns false when
+// nothing is left or the download stopped
+func (pr *ParallelReader) take() (int64, *streamChunk, bool) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	for {
+		if pr.err != nil || pr.next*pr.ChunkSize >= pr.TotalSize {
+			return 0, nil, false
+		}
+		if pr.next < pr.readIdx+pr.window {
+			index := pr.next
+			pr.next++
+			c := &streamChunk{data: make([]byte, min(pr.ChunkSize, pr.TotalSize-index*pr.ChunkSize))}
+			pr.chunks[index] = c
+			return index, c, true
+		}
+		pr.cond.Wait()
+	}
+}
+
+func (pr *ParallelReader) worker(wi *WorkerInfo) {
+	defer pr.wg.Done()
+	wi.started()
+	wi.HttpClient = pr.newClient()
+
+	for {
+		// a worker held back by the window is not judged by the health monitor
+		wi.setStatus(WorkerStatusIdle)
+		index, c, ok := pr.take()
+		if !ok {
+			break
+		}
+		start := index * pr.ChunkSize
+		end := start + int64(len(c.data)) - 1
+		pr.Events.publish(ChunkStarted{EventMeta: meta(wi.ID, index), Start: start, End: end, StolenFrom: -1, RacingWith: -1})
+
+		if err := pr.fetchChunk(wi, index, c); err != nil {
+			if pr.ctx.Err() == nil {
+				pr.Events.publish(ChunkFailed{EventMeta: meta(wi.ID, index), Start: start, End: end, Err: err})
+				pr.mu.Lock()
+				pr.stop(err)
+				pr.mu.Unlock()
+			}
+			break
+		}
+		pr.Events.publish(ChunkCompleted{EventMeta: meta(wi.ID, index), Start: start, End: end})
+
+		pr.mu.Lock()
+		c.done = true
+		pr.cond.Broadcast()
+		pr.mu.Unlock()
+	}
+	wi.setStatus(WorkerStatusDone)
+}
+
+// fetchChunk fills the chunk, a restart by the health monitor reconnects and goes on where it stopped
+func (pr *ParallelReader) fetchChunk(wi *WorkerInfo, index int64, c *streamChunk) error {
+	start := index * pr.ChunkSize
+	wi.startChunk(index, start, int64(len(c.data)))
+	wi.setStatus(WorkerStatusDownloading)
+
+	got := 0
+	for {
+		ctx, cancel := context.WithCancelCause(pr.ctx)
+		wi.setChunkCancel(cancel)
+		n, err := pr.fetcher.fetch(ctx, wi.HttpClient, rangeRequester{worker: wi, chunk: index}, c.data[got:], start+int64(got), func(n int64) {
+			wi.bytesWritten.Add(n)
+			wi.addChunkBytes(n)
+		})
+		wi.setChunkCancel(nil)
+		restarted := errors.Is(context.Cause(ctx), errWorkerRestarted)
+		cancel(nil)
+
+		got += n
+		if n > 0 {
+			pr.Events.publish(Progress{EventMeta: meta(wi.ID, index), Bytes: int64(n), Total: pr.fetched.Add(int64(n))})
+		}
+		if err == nil {
+			return nil
+		}
+		if !restarted || pr.ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-wi.RestartWorkerChan:
+		default:
+		}
+		wi.HttpClient = pr.newClient()
+		stats := wi.Snapshot()
+		pr.mu.Lock()
+		baseline := pr.baseline
+		pr.mu.Unlock()
+		pr.Events.publish(WorkerRestarted{EventMeta: meta(wi.ID, index), Speed: stats.Speed, Baseline: baseline, Offset: int64(got)})
+		wi.setStatus(WorkerStatusDownloading)
+	}
+}
+
+func (pr *ParallelReader) newClient() *http.Client {
+	if pr.Transport == nil {
+		return newWorkerClient(pr.Timeouts)
+	}
+	return &http.Client{Transport: pr.Transport}
+}
@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chunks that arrive out of order are still read in order
+func TestParallelReaderOrdering(t *testing.T) {
+	data := make([]byte, 10*minChunkSize+12345)
+	rand.New(rand.NewSource(1)).Read(data)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the lower the range the longer it takes
+		var start int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		time.Sleep(time.Duration(len(data)-int(start)) * 50 * time.Millisecond / time.Duration(len(data)))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	pr := NewParallelReader(srv.URL, int64(len(data)), Validators{})
+	pr.Workers = 4
+	pr.ChunkSize = minChunkSize
+	pr.Start(context.Background())
+	defer pr.Close()
+
+	got, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("read failed - %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("read bytes differ from the served ones")
+	}
+}
+
+// workers stop BufferSize ahead of the reader and go on as it reads
+func TestParallelReaderBufferSize(t *testing.T) {
+	data := make([]byte, 8*minChunkSize)
+	rand.New(rand.NewSource(2)).Read(data)
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	pr := NewParallelReader(srv.URL, int64(len(data)), Validators{})
+	pr.Workers = 4
+	pr.ChunkSize = minChunkSize
+	pr.BufferSize = 2 * minChunkSize
+	pr.Start(context.Background())
+	defer pr.Close()
+
+	var got []byte
+	for read := 0; read < 3; read++ {
+		// the buffer fills up and then nothing more is fetched until the reader makes room
+		wantFetched := min(int64(read+2)*minChunkSize, int64(len(data)))
+		waitFor(t, func() bool { return pr.fetched.Load() >= wantFetched })
+		time.Sleep(50 * time.Millisecond)
+		if fetched := pr.fetched.Load(); fetched != wantFetched {
+			t.Fatalf("fetched %d bytes with %d read, want %d", fetched, len(got), wantFetched)
+		}
+		if n := requests.Load(); n != int64(read+2) {
+			t.Fatalf("sent %d requests with %d bytes read, want %d", n, len(got), read+2)
+		}
+
+		chunk := make([]byte, minChunkSize)
+		if _, err := io.ReadFull(pr, chunk); err != nil {
+			t.Fatalf("read failed - %v", err)
+		}
+		got = append(got, chunk...)
+	}
+
+	rest, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("read failed - %v", err)
+	}
+	if !bytes.Equal(append(got, rest...), data) {
+		t.Error("read bytes differ from the served ones")
+	}
+}
+
+// <== Helper Functions ==>
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
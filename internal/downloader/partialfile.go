@@ -0,0 +1,163 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// PartialFile reads the output of a range download while it is still being written. Bytes that are
+// on disk are returned right away, a read of missing bytes blocks until a worker has written them and
+// the scheduler fetches them before anything else in the meantime
+type PartialFile struct {
+	rdi  *RangeDownloadInfo
+	file *os.File
+}
+
+// OpenPartial opens the output file for reading, it can be called before RangeDownload starts and
+// stays readable after it returned
+func (rdi *RangeDownloadInfo) OpenPartial() (*PartialFile, error) {
+	file, err := os.Open(rdi.Filename)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialFile{rdi: rdi, file: file}, nil
+}
+
+// Size is the size of the complete file
+func (pf *PartialFile) Size() int64 {
+	return pf.rdi.TotalSize
+}
+
+// ReadAt reads len(p) bytes at off, waiting for them to be downloaded if necessary
+func (pf *PartialFile) ReadAt(p []byte, off int64) (int, error) {
+	return pf.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is ReadAt that stops waiting for missing bytes once ctx is cancelled
+func (pf *PartialFile) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= pf.rdi.TotalSize {
+		return 0, io.EOF
+	}
+	r := byteRange{off, min(off+int64(len(p)), pf.rdi.TotalSize)}
+	if err := pf.wait(ctx, r); err != nil {
+		return 0, err
+	}
+	n, err := pf.file.ReadAt(p[:r.size()], off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (pf *PartialFile) Close() error {
+	return pf.file.Close()
+}
+
+// <== Helper Functions ==>
+
+// wait blocks until r is on disk, the scheduler knows about it for as long as it is missing
+func (pf *PartialFile) wait(ctx context.Context, r byteRange) error {
+	d := pf.rdi.demand
+	wanted := false
+	defer func() {
+		if wanted {
+			d.unwant(r)
+		}
+	}()
+
+	for {
+		ok, changed := pf.rdi.State.covers(r)
+		if ok {
+			return nil
+		}
+		if !wanted {
+			d.want(r)
+			wanted = true
+		}
+		select {
+		case <-changed:
+		case <-d.done:
+			// what is not on disk once the download returned never will be
+			if ok, _ := pf.rdi.State.covers(r); ok {
+				return nil
+			}
+			if d.err != nil {
+				return d.err
+			}
+			return errors.New("download ended before these bytes were written")
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// demand is the byte ranges readers of a PartialFile are blocked on, the scheduler hands them out first
+type demand struct {
+	mu     sync.Mutex
+	ranges []byteRange   // oldest first
+	wake   func()        // expedites the bytes with the running scheduler, nil before it starts
+	done   chan struct{} // closed once the download returned
+	err    error         // what it returned, set before done is closed
+}
+
+func newDemand() *demand {
+	return &demand{done: make(chan struct{})}
+}
+
+func (d *demand) want(r byteRange) {
+	d.mu.Lock()
+	d.ranges = append(d.ranges, r)
+	wake := d.wake
+	d.mu.Unlock()
+
+	// outside the lock, the scheduler reads the ranges while holding its own
+	if wake != nil {
+		wake()
+	}
+}
+
+func (d *demand) unwant(r byteRange) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, other := range d.ranges {
+		if other == r {
+			d.ranges = append(d.ranges[:i], d.ranges[i+1:]...)
+			return
+		}
+	}
+}
+
+// wanted returns a copy of the ranges readers are waiting for, oldest first
+func (d *demand) wanted() []byteRange {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]byteRange(nil), d.ranges...)
+}
+
+func (d *demand) setWake(wake func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.wake = wake
+}
+
+// finish wakes every reader once the download returned err
+func (d *demand) finish(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if isClosed(d.done) {
+		return
+	}
+	d.err = err
+	close(d.done)
+}
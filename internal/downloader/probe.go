@@ -0,0 +1,158 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const probeTimeout = 10 * time.Second
+
+// sent by the probe and by streams, so a server that names the file by client sees the same one
+const userAgent = "Mozilla/5.0 Downpour/1.0"
+
+// ProbeResult is what a request for the first byte of a file tells about it
+type ProbeResult struct {
+	URL         string
+	TotalSize   int64 // -1 when the server did not say
+	AcceptRange bool
+	Validators  Validators
+	Filename    string // from Content-Disposition, or the last element of the URL path
+}
+
+// Probe asks for the first byte of the file to learn its size and whether ranges are supported
+func Probe(ctx context.Context, rawURL string, header http.Header) (*ProbeResult, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	setHeaders(req, header)
+	req.Header.Set("Range", "bytes=0-0")
+
+	client := &http.Client{Timeout: probeTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("network error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// extract stuff from resp
+	result := &ProbeResult{
+		URL: rawURL,
+		Validators: Validators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		},
+		Filename: GetFileName(u, resp),
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		result.AcceptRange = true
+		result.TotalSize = -1
+		contentRange := resp.Header.Get("Content-Range")
+		if contentRange != "" {
+			parts := strings.Split(contentRange, "/")
+			if len(parts) == 2 {
+				fmt.Sscanf(parts[1], "%d", &result.TotalSize)
+			}
+		}
+	} else {
+		// fallback
+		result.TotalSize = resp.ContentLength
+		result.AcceptRange = false
+	}
+	return result, nil
+}
+
+// ProbeMirrors checks that every mirror serves the same file as the primary URL. Mirrors that can
+// not be reached or do not support ranges are skipped and listed in skipped, a mirror with a
+// different size or ETag fails the whole download
+func ProbeMirrors(ctx context.Context, primary *ProbeResult, urls []string, header http.Header) (mirrors *MirrorSet, skipped []error, err error) {
+	list := []*Mirror{{URL: primary.URL, Validators: primary.Validators}}
+	for _, mirrorURL := range urls {
+		mirror, err := Probe(ctx, mirrorURL, header)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("skipping mirror %s - %w", mirrorURL, err))
+			continue
+		}
+		if !mirror.AcceptRange {
+			skipped = append(skipped, fmt.Errorf("skipping mirror %s - range requests are not supported", mirrorURL))
+			continue
+		}
+		if mirror.TotalSize != primary.TotalSize {
+			return nil, skipped, fmt.Errorf("mirror %s reports a size of %d bytes, expected %d", mirrorURL, mirror.TotalSize, primary.TotalSize)
+		}
+		if primary.Validators.ETag != "" && mirror.Validators.ETag != "" && mirror.Validators.ETag != primary.Validators.ETag {
+			return nil, skipped, fmt.Errorf("mirror %s reports ETag %s, expected %s", mirrorURL, mirror.Validators.ETag, primary.Validators.ETag)
+		}
+		list = append(list, &Mirror{URL: mirrorURL, Validators: mirror.Validators})
+	}
+	return NewMirrorSet(list), skipped, nil
+}
+
+func GetFileName(u *url.URL, resp *http.Response) string {
+	contentDisposition := resp.Header.Get("Content-Disposition")
+
+	var name string
+	if contentDisposition != "" {
+		_, params, err := mime.ParseMediaType(contentDisposition)
+		if err == nil {
+			if fname, ok := params["filename"]; ok {
+				name = fname
+			} else if fname, ok := params["filename*"]; ok {
+				name = fname
+			}
+		}
+	}
+	if name == "" {
+		pathSlice := strings.Split(u.Path, "/")
+		name = pathSlice[len(pathSlice)-1]
+	}
+
+	// the server does not get to pick the directory
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == string(filepath.Separator) || name == "." {
+		return "download"
+	}
+	return name
+}
+
+// OutputPath resolves where a download of remoteName goes. A directory (one that exists or a path ending
+// in a separator) gets the file under its remote name, an empty output means the working directory
+func OutputPath(output string, remoteName string) string {
+	if output == "" {
+		return remoteName
+	}
+	if strings.HasSuffix(output, "/") || strings.HasSuffix(output, string(filepath.Separator)) {
+		return filepath.Join(output, remoteName)
+	}
+	if stat, err := os.Stat(output); err == nil && stat.IsDir() {
+		return filepath.Join(output, remoteName)
+	}
+	return output
+}
+
+// caller headers never override the ones the download depends on
+func setHeaders(req *http.Request, header http.Header) {
+	for key, values := range header {
+		switch http.CanonicalHeaderKey(key) {
+		case "Range", "If-Range":
+			continue
+		}
+		req.Header.Del(key)
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+}
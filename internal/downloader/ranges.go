@@ -0,0 +1,105 @@
+package downloader
+
+import "sort"
+
+// byteRange is the half-open interval [Start, End) of the file
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+func (r byteRange) size() int64 {
+	return r.End - r.Start
+}
+
+// rangeSet is a sorted list of disjoint ranges, touching ranges are merged
+type rangeSet []byteRange
+
+// add merges r into the set and returns how many of its bytes were not in the set before
+func (s *rangeSet) add(r byteRange) int64 {
+	if r.End <= r.Start {
+		return 0
+	}
+	set := *s
+
+	// first range that overlaps or touches r
+	i := sort.Search(len(set), func(i int) bool {
+		return set[i].End >= r.Start
+	})
+
+	merged := r
+	var overlap int64
+	j := i
+	for ; j < len(set) && set[j].Start <= r.End; j++ {
+		overlap += min(set[j].End, r.End) - max(set[j].Start, r.Start)
+		merged.Start = min(merged.Start, set[j].Start)
+		merged.End = max(merged.End, set[j].End)
+	}
+
+	*s = append(set[:i], append(rangeSet{merged}, set[j:]...)...)
+	return r.size() - overlap
+}
+
+func (s rangeSet) size() int64 {
+	var total int64
+	for _, r := range s {
+		total += r.size()
+	}
+	return total
+}
+
+// complement returns the parts of [0, total) that are not in the set
+func (s rangeSet) complement(total int64) rangeSet {
+	var gaps rangeSet
+	var pos int64
+	for _, r := range s {
+		if r.Start > pos {
+			gaps = append(gaps, byteRange{pos, r.Start})
+		}
+		pos = max(pos, r.End)
+	}
+	if pos < total {
+		gaps = append(gaps, byteRange{pos, total})
+	}
+	return gaps
+}
+
+// contains reports whether every byte of r is in the set
+func (s rangeSet) contains(r byteRange) bool {
+	if r.End <= r.Start {
+		return true
+	}
+	i := sort.Search(len(s), func(i int) bool {
+		return s[i].End > r.Start
+	})
+	return i < len(s) && s[i].Start <= r.Start && s[i].End >= r.End
+}
+
+// overlaps reports whether any byte of r is in the set
+func (s rangeSet) overlaps(r byteRange) bool {
+	i := sort.Search(len(s), func(i int) bool {
+		return s[i].End > r.Start
+	})
+	return i < len(s) && s[i].Start < r.End
+}
+
+// remove takes r out of the set, splitting the range it falls into if needed
+func (s *rangeSet) remove(r byteRange) {
+	if r.End <= r.Start {
+		return
+	}
+	var out rangeSet
+	for _, cur := range *s {
+		if cur.End <= r.Start || cur.Start >= r.End {
+			out = append(out, cur)
+			continue
+		}
+		if cur.Start < r.Start {
+			out = append(out, byteRange{cur.Start, r.Start})
+		}
+		if cur.End > r.End {
+			out = append(out, byteRange{r.End, cur.End})
+		}
+	}
+	*s = out
+}
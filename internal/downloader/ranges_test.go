@@ -0,0 +1,131 @@
+package downloader
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRangeSetAdd(t *testing.T) {
+	tests := []struct {
+		name      string
+		set       rangeSet
+		add       byteRange
+		want      rangeSet
+		wantAdded int64
+	}{
+		{"empty set", nil, byteRange{10, 20}, rangeSet{{10, 20}}, 10},
+		{"empty range", rangeSet{{0, 5}}, byteRange{7, 7}, rangeSet{{0, 5}}, 0},
+		{"inverted range", rangeSet{{0, 5}}, byteRange{9, 7}, rangeSet{{0, 5}}, 0},
+		{"before", rangeSet{{10, 20}}, byteRange{0, 5}, rangeSet{{0, 5}, {10, 20}}, 5},
+		{"after", rangeSet{{10, 20}}, byteRange{30, 40}, rangeSet{{10, 20}, {30, 40}}, 10},
+		{"touching left", rangeSet{{10, 20}}, byteRange{5, 10}, rangeSet{{5, 20}}, 5},
+		{"touching right", rangeSet{{10, 20}}, byteRange{20, 25}, rangeSet{{10, 25}}, 5},
+		{"overlapping", rangeSet{{10, 20}}, byteRange{15, 25}, rangeSet{{10, 25}}, 5},
+		{"inside", rangeSet{{10, 20}}, byteRange{12, 18}, rangeSet{{10, 20}}, 0},
+		{"duplicate", rangeSet{{10, 20}}, byteRange{10, 20}, rangeSet{{10, 20}}, 0},
+		{"covering", rangeSet{{10, 20}}, byteRange{5, 25}, rangeSet{{5, 25}}, 10},
+		{"bridging a gap", rangeSet{{0, 10}, {20, 30}}, byteRange{10, 20}, rangeSet{{0, 30}}, 10},
+		{"swallowing several", rangeSet{{0, 10}, {20, 30}, {40, 50}, {60, 70}}, byteRange{5, 45}, rangeSet{{0, 50}, {60, 70}}, 20},
+		{"into a gap", rangeSet{{0, 10}, {40, 50}}, byteRange{20, 30}, rangeSet{{0, 10}, {20, 30}, {40, 50}}, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := slices.Clone(tt.set)
+			added := set.add(tt.add)
+			if !slices.Equal(set, tt.want) {
+				t.Errorf("add(%v) to %v = %v, want %v", tt.add, tt.set, set, tt.want)
+			}
+			if added != tt.wantAdded {
+				t.Errorf("add(%v) to %v added %d bytes, want %d", tt.add, tt.set, added, tt.wantAdded)
+			}
+		})
+	}
+}
+
+func TestRangeSetRemove(t *testing.T) {
+	tests := []struct {
+		name   string
+		set    rangeSet
+		remove byteRange
+		want   rangeSet
+	}{
+		{"empty set", nil, byteRange{0, 10}, nil},
+		{"empty range", rangeSet{{0, 10}}, byteRange{5, 5}, rangeSet{{0, 10}}},
+		{"disjoint", rangeSet{{0, 10}}, byteRange{20, 30}, rangeSet{{0, 10}}},
+		{"touching", rangeSet{{0, 10}}, byteRange{10, 20}, rangeSet{{0, 10}}},
+		{"whole range", rangeSet{{0, 10}, {20, 30}}, byteRange{0, 10}, rangeSet{{20, 30}}},
+		{"front", rangeSet{{0, 10}}, byteRange{0, 4}, rangeSet{{4, 10}}},
+		{"back", rangeSet{{0, 10}}, byteRange{6, 10}, rangeSet{{0, 6}}},
+		{"middle splits", rangeSet{{0, 10}}, byteRange{4, 6}, rangeSet{{0, 4}, {6, 10}}},
+		{"across a gap", rangeSet{{0, 10}, {20, 30}}, byteRange{5, 25}, rangeSet{{0, 5}, {25, 30}}},
+		{"everything", rangeSet{{0, 10}, {20, 30}}, byteRange{0, 30}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := slices.Clone(tt.set)
+			set.remove(tt.remove)
+			if !slices.Equal(set, tt.want) {
+				t.Errorf("remove(%v) from %v = %v, want %v", tt.remove, tt.set, set, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeSetComplement(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   rangeSet
+		total int64
+		want  rangeSet
+	}{
+		{"nothing done", nil, 100, rangeSet{{0, 100}}},
+		{"everything done", rangeSet{{0, 100}}, 100, nil},
+		{"front done", rangeSet{{0, 40}}, 100, rangeSet{{40, 100}}},
+		{"back done", rangeSet{{60, 100}}, 100, rangeSet{{0, 60}}},
+		{"holes", rangeSet{{10, 20}, {50, 60}}, 100, rangeSet{{0, 10}, {20, 50}, {60, 100}}},
+		{"empty file", nil, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.set.complement(tt.total)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("%v.complement(%d) = %v, want %v", tt.set, tt.total, got, tt.want)
+			}
+			// what is missing and what is done always make up the whole file
+			if size := got.size() + tt.set.size(); size != tt.total {
+				t.Errorf("missing and done add up to %d bytes, want %d", size, tt.total)
+			}
+		})
+	}
+}
+
+func TestRangeSetContainsOverlaps(t *testing.T) {
+	set := rangeSet{{10, 20}, {30, 40}}
+	tests := []struct {
+		r            byteRange
+		wantContains bool
+		wantOverlaps bool
+	}{
+		{byteRange{0, 10}, false, false},
+		{byteRange{10, 20}, true, true},
+		{byteRange{12, 18}, true, true},
+		{byteRange{5, 15}, false, true},
+		{byteRange{15, 35}, false, true},
+		{byteRange{20, 30}, false, false},
+		{byteRange{39, 45}, false, true},
+		{byteRange{40, 50}, false, false},
+		{byteRange{25, 25}, true, false},
+	}
+
+	for _, tt := range tests {
+		if got := set.contains(tt.r); got != tt.wantContains {
+			t.Errorf("%v.contains(%v) = %v, want %v", set, tt.r, got, tt.wantContains)
+		}
+		if got := set.overlaps(tt.r); got != tt.wantOverlaps {
+			t.Errorf("%v.overlaps(%v) = %v, want %v", set, tt.r, got, tt.wantOverlaps)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package downloader
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const defaultBlockSize = 1024 * 1024 // 1MB
+const defaultCacheBlocks = 64
+const defaultReadahead = 4
+const defaultRemoteWorkers = 8
+
+// RemoteFile reads a remote file at any offset without downloading all of it. Reads are served from
+// cached blocks, a block that several readers want at once is only requested once and a sequential
+// reader gets the next blocks fetched in parallel ahead of it.
+// The exported fields can be changed until the first read
+type RemoteFile struct {
+	URL         string
+	TotalSize   int64
+	Mirrors     *MirrorSet
+	Header      http.Header
+	RetryPolicy RetryPolicy
+	Timeouts    Timeouts
+	BlockSize   int64 // bytes per request, the unit of the cache
+	CacheBlocks int   // blocks kept in memory
+	Readahead   int   // blocks fetched ahead of a sequential reader, 0 disables readahead
+	Workers     int   // parallel requests
+
+	initOnce sync.Once
+	fetcher  *rangeFetcher
+	slots    chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	blocks  map[int64]*block
+	lru     *list.List // most recently used block at the front
+	lastEnd int64      // where the previous read ended, a read starting there is sequential
+
+	seekMu sync.Mutex
+	offset int64 // position of Read and Seek
+}
+
+type block struct {
+	index int64
+	data  []byte
+	err   error
+	ready chan struct{} // closed once data or err is set
+	elem  *list.Element
+}
+
+func NewRemoteFile(reqURL string, totalSize int64, validators Validators) *RemoteFile {
+	return &RemoteFile{
+		URL:         reqURL,
+		TotalSize:   totalSize,
+		Mirrors:     NewMirrorSet([]*Mirror{{URL: reqURL, Validators: validators}}),
+		RetryPolicy: DefaultRetryPolicy,
+		Timeouts:    DefaultTimeouts,
+		BlockSize:   defaultBlockSize,
+		CacheBlocks: defaultCacheBlocks,
+		Readahead:   defaultReadahead,
+		Workers:     defaultRemoteWorkers,
+	}
+}
+
+func (rf *RemoteFile) init() {
+	rf.initOnce.Do(func() {
+		rf.BlockSize = max(rf.BlockSize, 1)
+		rf.CacheBlocks = max(rf.CacheBlocks, 1)
+		rf.fetcher = newRangeFetcher(rf.Mirrors, rf.Header, rf.TotalSize, rf.RetryPolicy, rf.Timeouts)
+		rf.slots = make(chan struct{}, max(rf.Workers, 1))
+		rf.ctx, rf.cancel = context.WithCancel(context.Background())
+		rf.blocks = make(map[int64]*block)
+		rf.lru = list.New()
+	})
+}
+
+// Size is the size of the remote file
+func (rf *RemoteFile) Size() int64 {
+	return rf.TotalSize
+}
+
+// ReadAt reads len(p) bytes at off, it is safe to call from several goroutines at once
+func (rf *RemoteFile) ReadAt(p []byte, off int64) (int, error) {
+	rf.init()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if rf.ctx.Err() != nil {
+		return 0, os.ErrClosed
+	}
+	if off >= rf.TotalSize {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	end := min(off+int64(len(p)), rf.TotalSize)
+	first := off / rf.BlockSize
+	last := (end - 1) / rf.BlockSize
+
+	rf.mu.Lock()
+	blocks := make([]*block, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		blocks = append(blocks, rf.block(i))
+	}
+	if off == rf.lastEnd {
+		for i := last + 1; i <= last+int64(rf.Readahead) && i*rf.BlockSize < rf.TotalSize; i++ {
+			rf.block(i)
+		}
+	}
+	rf.lastEnd = end
+	rf.mu.Unlock()
+
+	n := 0
+	for _, b := range blocks {
+		select {
+		case <-b.ready:
+		case <-rf.ctx.Done():
+			return n, os.ErrClosed
+		}
+		if b.err != nil {
+			return n, b.err
+		}
+		n += copy(p[n:], b.data[off+int64(n)-b.index*rf.BlockSize:])
+	}
+	if int64(n) < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read reads from the position set by Seek
+func (rf *RemoteFile) Read(p []byte) (int, error) {
+	rf.seekMu.Lock()
+	defer rf.seekMu.Unlock()
+
+	n, err := rf.ReadAt(p, rf.offset)
+	rf.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (rf *RemoteFile) Seek(offset int64, whence int) (int64, error) {
+	rf.seekMu.Lock()
+	defer rf.seekMu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += rf.offset
+	case io.SeekEnd:
+		offset += rf.TotalSize
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	rf.offset = offset
+	return offset, nil
+}
+
+// Close stops the requests in flight and drops the cache
+func (rf *RemoteFile) Close() error {
+	rf.init()
+	rf.cancel()
+	rf.wg.Wait()
+
+	rf.mu.Lock()
+	rf.blocks = make(map[int64]*block)
+	rf.lru.Init()
+	rf.mu.Unlock()
+	return nil
+}
+
+// <== Helper Functions ==>
+
+// block returns the cached block or starts fetching it, caller must hold the lock
+func (rf *RemoteFile) block(index int64) *block {
+	if b, ok := rf.blocks[index]; ok {
+		rf.lru.MoveToFront(b.elem)
+		return b
+	}
+
+	b := &block{index: index, ready: make(chan struct{})}
+	b.elem = rf.lru.PushFront(b)
+	rf.blocks[index] = b
+	rf.evict()
+
+	rf.wg.Add(1)
+	go rf.fetch(b)
+	return b
+}
+
+// evict drops the least recently used blocks that are not in flight, caller must hold the lock
+func (rf *RemoteFile) evict() {
+	for e := rf.lru.Back(); e != nil && rf.lru.Len() > rf.CacheBlocks; {
+		prev := e.Prev()
+		b := e.Value.(*block)
+		if isClosed(b.ready) {
+			rf.lru.Remove(e)
+			delete(rf.blocks, b.index)
+		}
+		e = prev
+	}
+}
+
+func (rf *RemoteFile) fetch(b *block) {
+	defer rf.wg.Done()
+	defer close(b.ready)
+
+	select {
+	case rf.slots <- struct{}{}:
+	case <-rf.ctx.Done():
+		b.err = os.ErrClosed
+		rf.drop(b)
+		return
+	}
+	defer func() { <-rf.slots }()
+
+	start := b.index * rf.BlockSize
+	data := make([]byte, min(rf.BlockSize, rf.TotalSize-start))
+	if _, err := rf.fetcher.fetch(rf.ctx, rf.fetcher.client, rangeRequester{chunk: b.index}, data, start, nil); err != nil {
+		if rf.ctx.Err() != nil {
+			err = os.ErrClosed
+		}
+		b.err = err
+		// the next read asks again instead of getting the cached error
+		rf.drop(b)
+		return
+	}
+	b.data = data
+}
+
+func (rf *RemoteFile) drop(b *block) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.blocks[b.index] == b {
+		rf.lru.Remove(b.elem)
+		delete(rf.blocks, b.index)
+	}
+}
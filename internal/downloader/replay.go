@@ -0,0 +1,247 @@
+package downloader
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a restarted worker is assumed to send nothing for this long while it reconnects
+const replayRestartPenalty = 1 * time.Second
+
+type telemetrySample struct {
+	at     time.Duration
+	total  int64
+	speeds []float64
+}
+
+// Telemetry is a run recorded with --telemetry, loaded for replaying it through health policies
+type Telemetry struct {
+	Workers int
+	samples []telemetrySample
+}
+
+// LoadTelemetry parses a telemetry CSV, worker columns are recognised by their W<n>(B/s) header
+func LoadTelemetry(r io.Reader) (*Telemetry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read telemetry header - %w", err)
+	}
+
+	timeCol, totalCol := -1, -1
+	var workerCols []int
+	for i, name := range header {
+		switch {
+		case name == "Timestamp(s)":
+			timeCol = i
+		case name == "TotalBytes":
+			totalCol = i
+		case strings.HasPrefix(name, "W") && strings.HasSuffix(name, "(B/s)"):
+			workerCols = append(workerCols, i)
+		}
+	}
+	if timeCol < 0 || totalCol < 0 || len(workerCols) == 0 {
+		return nil, fmt.Errorf("not a downpour telemetry file, missing Timestamp(s), TotalBytes or worker columns")
+	}
+
+	t := &Telemetry{Workers: len(workerCols)}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d - %w", line, err)
+		}
+
+		seconds, err := strconv.ParseFloat(field(record, timeCol), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d - bad timestamp - %w", line, err)
+		}
+		total, err := strconv.ParseInt(field(record, totalCol), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d - bad total bytes - %w", line, err)
+		}
+		sample := telemetrySample{
+			at:     time.Duration(seconds * float64(time.Second)),
+			total:  total,
+			speeds: make([]float64, len(workerCols)),
+		}
+		for i, col := range workerCols {
+			// a missing or empty column is a worker that was not running
+			if speed, err := strconv.ParseFloat(field(record, col), 64); err == nil {
+				sample.speeds[i] = speed
+			}
+		}
+		t.samples = append(t.samples, sample)
+	}
+
+	if len(t.samples) == 0 {
+		return nil, fmt.Errorf("telemetry file has no samples")
+	}
+	return t, nil
+}
+
+// ReplayRestart is a restart the policy would have issued
+type ReplayRestart struct {
+	At       time.Duration
+	WorkerID int
+	Speed    float64
+	Baseline float64
+}
+
+// ReplayReport compares a policy against the recorded run
+type ReplayReport struct {
+	Policy            string
+	Samples           int
+	TotalBytes        int64
+	RecordedDuration  time.Duration
+	EstimatedDuration time.Duration
+	Restarts          []ReplayRestart
+	IgnoredActions    int // retire, spawn and throttle are not simulated
+}
+
+// Replay feeds the recorded worker speeds to the policy on a simulated clock. A worker the policy
+// restarts is assumed to come back at the policy's baseline speed after replayRestartPenalty, and the
+// whole download never goes faster than the best throughput the link showed during the recording.
+// A worker counts as busy while its recorded speed is above 0, once it drops back to 0 it finished (or
+// was parked) and whatever speed a restart gave it is gone with it.
+func (t *Telemetry) Replay(policy HealthPolicy) ReplayReport {
+	last := t.samples[len(t.samples)-1]
+	report := ReplayReport{
+		Policy:           policy.Name(),
+		Samples:          len(t.samples),
+		TotalBytes:       last.total,
+		RecordedDuration: last.at,
+	}
+
+	// the fastest the link ever went between two samples caps the simulated throughput
+	var peakRate float64
+	for i := 1; i < len(t.samples); i++ {
+		dt := (t.samples[i].at - t.samples[i-1].at).Seconds()
+		if dt > 0 {
+			peakRate = max(peakRate, float64(t.samples[i].total-t.samples[i-1].total)/dt)
+		}
+	}
+
+	busy := make([]bool, t.Workers)
+	restartedAt := make([]time.Duration, t.Workers)
+	penaltyUntil := make([]time.Duration, t.Workers)
+	boosted := make([]float64, t.Workers) // speed assumed after a restart
+
+	simulated := func(i int, s telemetrySample) float64 {
+		if s.at < penaltyUntil[i] {
+			return 0
+		}
+		return max(s.speeds[i], boosted[i])
+	}
+
+	var simBytes float64
+	estimated := time.Duration(-1)
+	var nextEval time.Duration
+	prev := telemetrySample{}
+
+	for _, s := range t.samples {
+		for i, speed := range s.speeds {
+			switch {
+			case speed > 0 && !busy[i]:
+				busy[i] = true
+				restartedAt[i] = s.at
+			case speed == 0 && busy[i]:
+				busy[i] = false
+				boosted[i] = 0
+				penaltyUntil[i] = 0
+			}
+		}
+
+		// scale what was really downloaded in this interval by how much faster the simulated workers are
+		dt := (s.at - prev.at).Seconds()
+		delta := float64(s.total - prev.total)
+		var recordedRate, simulatedRate float64
+		for i := range s.speeds {
+			recordedRate += s.speeds[i]
+			simulatedRate += simulated(i, s)
+		}
+		if recordedRate > 0 {
+			delta *= simulatedRate / recordedRate
+		}
+		if dt > 0 && peakRate > 0 {
+			delta = min(delta, peakRate*dt)
+		}
+		if estimated < 0 && delta > 0 && simBytes+delta >= float64(last.total) {
+			frac := (float64(last.total) - simBytes) / delta
+			estimated = prev.at + time.Duration(frac*float64(s.at-prev.at))
+		}
+		simBytes += delta
+		prev = s
+
+		if s.at < nextEval {
+			continue
+		}
+		nextEval = s.at + policy.Interval()
+
+		snapshot := HealthSnapshot{
+			BytesWritten: s.total,
+			TotalSize:    last.total,
+			WorkerLimit:  t.Workers,
+		}
+		for i := range s.speeds {
+			if !busy[i] {
+				continue
+			}
+			snapshot.Workers = append(snapshot.Workers, WorkerStats{
+				ID:           i,
+				Speed:        simulated(i, s),
+				Status:       WorkerStatusDownloading,
+				SinceRestart: s.at - restartedAt[i],
+			})
+		}
+		snapshot.ActiveWorkers = len(snapshot.Workers)
+		if len(snapshot.Workers) == 0 {
+			continue
+		}
+
+		decision := policy.Evaluate(snapshot)
+		for _, action := range decision.Actions {
+			if action.Kind != ActionRestart || action.WorkerID < 0 || action.WorkerID >= t.Workers {
+				report.IgnoredActions++
+				continue
+			}
+			i := action.WorkerID
+			report.Restarts = append(report.Restarts, ReplayRestart{
+				At:       s.at,
+				WorkerID: i,
+				Speed:    simulated(i, s),
+				Baseline: decision.Baseline,
+			})
+			restartedAt[i] = s.at
+			penaltyUntil[i] = s.at + replayRestartPenalty
+			boosted[i] = decision.Baseline
+		}
+	}
+
+	if estimated < 0 {
+		// restarts cost more than they gained, extrapolate the missing bytes at the average rate of the recording
+		estimated = last.at
+		if rate := float64(last.total) / math.Max(last.at.Seconds(), 1); simBytes < float64(last.total) && rate > 0 {
+			estimated += time.Duration((float64(last.total) - simBytes) / rate * float64(time.Second))
+		}
+	}
+	report.EstimatedDuration = estimated
+	return report
+}
+
+// <== Helper Functions ==>
+func field(record []string, i int) string {
+	if i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
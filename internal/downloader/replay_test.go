@@ -0,0 +1,202 @@
+package downloader
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadTelemetry(t *testing.T) {
+	tests := []struct {
+		name        string
+		csv         string
+		wantErr     bool
+		wantWorkers int
+		wantSpeeds  [][]float64
+	}{
+		{
+			name:        "two workers",
+			csv:         "Timestamp(s),TotalBytes,W0(B/s),W1(B/s)\n0.5,100,150,50\n1.0,250,200,100\n",
+			wantWorkers: 2,
+			wantSpeeds:  [][]float64{{150, 50}, {200, 100}},
+		},
+		{
+			name:        "columns found by header and unknown ones ignored",
+			csv:         "W0(B/s),Note,TotalBytes,W1(B/s),Timestamp(s)\n150,x,100,50,0.5\n",
+			wantWorkers: 2,
+			wantSpeeds:  [][]float64{{150, 50}},
+		},
+		{
+			name:        "empty or missing worker field is a parked worker",
+			csv:         "Timestamp(s),TotalBytes,W0(B/s),W1(B/s)\n0.5,100,,50\n1.0,200,100\n",
+			wantWorkers: 2,
+			wantSpeeds:  [][]float64{{0, 50}, {100, 0}},
+		},
+		{name: "empty file", csv: "", wantErr: true},
+		{name: "header only", csv: "Timestamp(s),TotalBytes,W0(B/s)\n", wantErr: true},
+		{name: "no worker columns", csv: "Timestamp(s),TotalBytes\n0.5,100\n", wantErr: true},
+		{name: "no total column", csv: "Timestamp(s),W0(B/s)\n0.5,100\n", wantErr: true},
+		{name: "bad timestamp", csv: "Timestamp(s),TotalBytes,W0(B/s)\nsoon,100,100\n", wantErr: true},
+		{name: "bad total", csv: "Timestamp(s),TotalBytes,W0(B/s)\n0.5,lots,100\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			telemetry, err := LoadTelemetry(strings.NewReader(tt.csv))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("LoadTelemetry accepted a broken telemetry file")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadTelemetry failed - %v", err)
+			}
+			if telemetry.Workers != tt.wantWorkers {
+				t.Errorf("loaded %d workers, want %d", telemetry.Workers, tt.wantWorkers)
+			}
+			var speeds [][]float64
+			for _, s := range telemetry.samples {
+				speeds = append(speeds, s.speeds)
+			}
+			if !slices.EqualFunc(speeds, tt.wantSpeeds, slices.Equal[[]float64]) {
+				t.Errorf("loaded speeds %v, want %v", speeds, tt.wantSpeeds)
+			}
+		})
+	}
+}
+
+// two workers at 100 B/s sampled every half second for 5 seconds
+const steadyTelemetry = `Timestamp(s),TotalBytes,W0(B/s),W1(B/s)
+0,0,100,100
+0.5,100,100,100
+1.0,200,100,100
+1.5,300,100,100
+2.0,400,100,100
+2.5,500,100,100
+3.0,600,100,100
+3.5,700,100,100
+4.0,800,100,100
+4.5,900,100,100
+5.0,1000,100,100
+`
+
+// W1 slows down after 2 seconds while the link could do 200 B/s
+const slowWorkerTelemetry = `Timestamp(s),TotalBytes,W0(B/s),W1(B/s)
+0,0,100,100
+1,200,100,100
+2,400,100,100
+3,510,100,10
+4,620,100,10
+5,730,100,10
+6,840,100,10
+7,950,100,10
+8,1060,100,10
+9,1170,100,10
+10,1280,100,10
+`
+
+// W1 slows down and then finishes at 4 seconds while W0 keeps going
+const finishingWorkerTelemetry = `Timestamp(s),TotalBytes,W0(B/s),W1(B/s)
+0,0,100,100
+1,200,100,100
+2,310,100,10
+3,420,100,10
+4,520,100,0
+5,620,100,0
+6,720,100,0
+`
+
+func TestReplay(t *testing.T) {
+	restart := func(id int) []HealthAction {
+		return []HealthAction{{Kind: ActionRestart, WorkerID: id}}
+	}
+	tests := []struct {
+		name          string
+		csv           string
+		policy        *scriptedPolicy
+		wantEstimated time.Duration
+		wantRestarts  []ReplayRestart
+		wantIgnored   int
+	}{
+		{
+			name:          "no restarts matches the recording",
+			csv:           slowWorkerTelemetry,
+			policy:        &scriptedPolicy{baseline: 100},
+			wantEstimated: 10 * time.Second,
+		},
+		{
+			name:          "restarting the slow worker saves time up to the link's peak",
+			csv:           slowWorkerTelemetry,
+			policy:        &scriptedPolicy{baseline: 100, actions: map[int][]HealthAction{4: restart(1)}},
+			wantEstimated: 7300 * time.Millisecond,
+			wantRestarts:  []ReplayRestart{{At: 4 * time.Second, WorkerID: 1, Speed: 10, Baseline: 100}},
+		},
+		{
+			name:          "a finished worker keeps no speed from its restart",
+			csv:           finishingWorkerTelemetry,
+			policy:        &scriptedPolicy{baseline: 100, actions: map[int][]HealthAction{2: restart(1)}},
+			wantEstimated: 5100 * time.Millisecond,
+			wantRestarts:  []ReplayRestart{{At: 2 * time.Second, WorkerID: 1, Speed: 10, Baseline: 100}},
+		},
+		{
+			name:          "a restart that only costs is extrapolated at the average rate",
+			csv:           steadyTelemetry,
+			policy:        &scriptedPolicy{baseline: 100, actions: map[int][]HealthAction{0: restart(0)}},
+			wantEstimated: 5250 * time.Millisecond,
+			wantRestarts:  []ReplayRestart{{At: 0, WorkerID: 0, Speed: 100, Baseline: 100}},
+		},
+		{
+			name:          "other actions are not simulated",
+			csv:           steadyTelemetry,
+			policy:        &scriptedPolicy{baseline: 100, always: []HealthAction{{Kind: ActionRetire, WorkerID: 0}, {Kind: ActionRestart, WorkerID: 7}}},
+			wantEstimated: 5 * time.Second,
+			wantIgnored:   12, // two on each of the 6 evaluations
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			telemetry, err := LoadTelemetry(strings.NewReader(tt.csv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			report := telemetry.Replay(tt.policy)
+
+			if diff := report.EstimatedDuration - tt.wantEstimated; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf("estimated %v, want %v", report.EstimatedDuration, tt.wantEstimated)
+			}
+			if !slices.Equal(report.Restarts, tt.wantRestarts) {
+				t.Errorf("restarts %v, want %v", report.Restarts, tt.wantRestarts)
+			}
+			if report.IgnoredActions != tt.wantIgnored {
+				t.Errorf("ignored %d actions, want %d", report.IgnoredActions, tt.wantIgnored)
+			}
+		})
+	}
+}
+
+// <== Helper Functions ==>
+
+// scriptedPolicy returns the actions planned for each evaluation (counted from 0) plus always
+type scriptedPolicy struct {
+	baseline float64
+	actions  map[int][]HealthAction
+	always   []HealthAction
+	calls    int
+}
+
+func (p *scriptedPolicy) Name() string {
+	return "scripted"
+}
+
+func (p *scriptedPolicy) Interval() time.Duration {
+	return time.Second
+}
+
+func (p *scriptedPolicy) Evaluate(s HealthSnapshot) HealthDecision {
+	actions := append(slices.Clone(p.always), p.actions[p.calls]...)
+	p.calls++
+	return HealthDecision{Baseline: p.baseline, Actions: actions}
+}
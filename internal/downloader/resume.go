@@ -0,0 +1,177 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// control file is kept next to the output file while a range download is in progress
+const controlFileExt = ".downpour"
+
+// validators reported by the server, used to make sure we resume the same remote file
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// bumped whenever the layout changes, control files of another version are ignored
+const controlFileVersion = 2
+
+// on-disk layout of the control file
+type controlFile struct {
+	Version      int      `json:"version"`
+	URL          string   `json:"url"`
+	TotalSize    int64    `json:"total_size"`
+	ETag         string   `json:"etag,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+	Completed    rangeSet `json:"completed"`
+}
+
+// ResumeState tracks which byte ranges are on disk so an interrupted download can pick up where it left off
+type ResumeState struct {
+	mu        sync.Mutex
+	path      string
+	completed rangeSet
+	changed   chan struct{} // closed once more bytes are on disk, see covers
+	finished  bool
+	Resumed   bool
+}
+
+func newResumeState(path string) *ResumeState {
+	return &ResumeState{path: path}
+}
+
+// loadResumeState reads the control file at path and returns a state only if it describes the same remote file
+func loadResumeState(path string, totalSize int64, validators Validators) *ResumeState {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var cf controlFile
+	if err := json.Unmarshal(data, &cf); err != nil {
+		return nil
+	}
+
+	if cf.Version != controlFileVersion || cf.TotalSize != totalSize {
+		return nil
+	}
+	// a changed validator means the remote file was replaced, the bytes on disk are worthless
+	if cf.ETag != validators.ETag || cf.LastModified != validators.LastModified {
+		return nil
+	}
+
+	state := newResumeState(path)
+	for _, r := range cf.Completed {
+		if r.Start >= 0 && r.End <= totalSize {
+			state.completed.add(r)
+		}
+	}
+	state.Resumed = true
+	return state
+}
+
+// missing returns the byte ranges of the file that are not on disk yet
+func (s *ResumeState) missing(totalSize int64) rangeSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.completed.complement(totalSize)
+}
+
+// markDone records r as written and returns how many of its bytes were new
+func (s *ResumeState) markDone(r byteRange) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added := s.completed.add(r)
+	if added > 0 {
+		s.notify()
+	}
+	return added
+}
+
+// covers reports whether all of r is on disk, if not the returned channel is closed the next time
+// bytes are added (or the state is reset)
+func (s *ResumeState) covers(r byteRange) (bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.completed.contains(r) {
+		return true, nil
+	}
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return false, s.changed
+}
+
+// reset forgets every byte on disk, the download starts over against a new version of the file
+func (s *ResumeState) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.completed = nil
+	s.finished = false
+	s.Resumed = false
+	s.notify()
+}
+
+// caller must hold the lock
+func (s *ResumeState) notify() {
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// CompletedBytes returns the number of bytes that are already on disk
+func (s *ResumeState) CompletedBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.completed.size()
+}
+
+// save atomically rewrites the control file with the current state
+func (s *ResumeState) save(rdi *RangeDownloadInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.finished {
+		return nil
+	}
+
+	cf := controlFile{
+		Version:      controlFileVersion,
+		URL:          rdi.ReqURL,
+		TotalSize:    rdi.TotalSize,
+		ETag:         rdi.Validators.ETag,
+		LastModified: rdi.Validators.LastModified,
+		Completed:    s.completed,
+	}
+	data, err := json.Marshal(cf)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("could not write control file %q - %w", s.path, err)
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// remove deletes the control file once the download has completed
+func (s *ResumeState) remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.finished = true
+	os.Remove(s.path + ".tmp")
+	err := os.Remove(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package downloader
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestControlFileRoundTrip(t *testing.T) {
+	const totalSize = 1000
+	validators := Validators{ETag: `"v1"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+
+	tests := []struct {
+		name        string
+		done        []byteRange
+		totalSize   int64
+		validators  Validators
+		wantMissing rangeSet // nil together with wantNil
+		wantNil     bool
+	}{
+		{"nothing done", nil, totalSize, validators, rangeSet{{0, totalSize}}, false},
+		{"holes", []byteRange{{0, 100}, {300, 400}, {350, 500}}, totalSize, validators, rangeSet{{100, 300}, {500, totalSize}}, false},
+		{"everything done", []byteRange{{0, totalSize}}, totalSize, validators, nil, false},
+		{"other size", []byteRange{{0, 100}}, totalSize + 1, validators, nil, true},
+		{"other etag", []byteRange{{0, 100}}, totalSize, Validators{ETag: `"v2"`, LastModified: validators.LastModified}, nil, true},
+		{"other last modified", []byteRange{{0, 100}}, totalSize, Validators{ETag: validators.ETag}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file"+controlFileExt)
+			rdi := &RangeDownloadInfo{ReqURL: "http://example.com/file", TotalSize: totalSize, Validators: validators}
+
+			state := newResumeState(path)
+			var written int64
+			for _, r := range tt.done {
+				written += state.markDone(r)
+			}
+			if err := state.save(rdi); err != nil {
+				t.Fatalf("save failed - %v", err)
+			}
+
+			loaded := loadResumeState(path, tt.totalSize, tt.validators)
+			if tt.wantNil {
+				if loaded != nil {
+					t.Fatalf("loadResumeState resumed a control file of another remote file")
+				}
+				return
+			}
+			if loaded == nil {
+				t.Fatalf("loadResumeState did not resume its own control file")
+			}
+			if !loaded.Resumed {
+				t.Errorf("loaded state is not marked as resumed")
+			}
+			if got := loaded.CompletedBytes(); got != written {
+				t.Errorf("loaded state has %d bytes completed, want %d", got, written)
+			}
+			if got := loaded.missing(tt.totalSize); !slices.Equal(got, tt.wantMissing) {
+				t.Errorf("loaded state is missing %v, want %v", got, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestLoadResumeStateRejects(t *testing.T) {
+	validators := Validators{ETag: `"v1"`}
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not json", "not a control file"},
+		{"other version", `{"version":1,"total_size":100,"etag":"\"v1\"","completed":[{"start":0,"end":10}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file"+controlFileExt)
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if state := loadResumeState(path, 100, validators); state != nil {
+				t.Errorf("loadResumeState accepted %q", tt.data)
+			}
+		})
+	}
+
+	if state := loadResumeState(filepath.Join(t.TempDir(), "missing"+controlFileExt), 100, validators); state != nil {
+		t.Errorf("loadResumeState returned a state without a control file")
+	}
+}
+
+func TestLoadResumeStateDropsOutOfBounds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file"+controlFileExt)
+	cf := controlFile{
+		Version:   controlFileVersion,
+		TotalSize: 100,
+		Completed: rangeSet{{-10, 10}, {20, 30}, {90, 110}},
+	}
+	data, err := json.Marshal(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state := loadResumeState(path, 100, Validators{})
+	if state == nil {
+		t.Fatal("loadResumeState did not resume a matching control file")
+	}
+	// a range outside the file can only come from a damaged control file, those bytes are fetched again
+	if got, want := state.missing(100), (rangeSet{{0, 20}, {30, 100}}); !slices.Equal(got, want) {
+		t.Errorf("state is missing %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// returned (wrapped) when the server answered with a status that will not change on retry
+var ErrPermanent = errors.New("permanent error")
+
+// returned when all workers together used up the retry budget
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+type RetryPolicy struct {
+	MaxRetries int           // attempts per chunk
+	BaseDelay  time.Duration // first backoff, doubled on every attempt
+	MaxDelay   time.Duration // cap for both backoff and Retry-After
+	Budget     int           // retries shared by every worker, refilled slowly by successful chunks
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	BaseDelay:  500 * time.Millisecond,
+	MaxDelay:   30 * time.Second,
+	Budget:     100,
+}
+
+// statuses that will not get better by asking again
+var permanentStatus = map[int]bool{
+	http.StatusForbidden:                    true,
+	http.StatusNotFound:                     true,
+	http.StatusGone:                         true,
+	http.StatusRequestedRangeNotSatisfiable: true,
+}
+
+// statuses that mean the server wants us to slow down
+var throttleStatus = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusServiceUnavailable: true,
+}
+
+// backoff returns an exponential delay with full jitter for the given attempt (starting at 0)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << min(attempt, 30)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return time.Duration(rand.Int64N(int64(delay) + 1))
+}
+
+// retryAfter parses the Retry-After header which is either a number of seconds or an HTTP date
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// retryGate is shared by all workers so a throttled server sees everyone back off together
+type retryGate struct {
+	mu         sync.Mutex
+	pauseUntil time.Time
+	tokens     float64
+	maxTokens  float64
+}
+
+func newRetryGate(budget int) *retryGate {
+	return &retryGate{
+		tokens:    float64(budget),
+		maxTokens: float64(budget),
+	}
+}
+
+// wait blocks while the gate is paused
+func (g *retryGate) wait(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		delay := time.Until(g.pauseUntil)
+		g.mu.Unlock()
+
+		if delay <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pause holds back every worker for at least d
+func (g *retryGate) pause(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if until.After(g.pauseUntil) {
+		g.pauseUntil = until
+	}
+}
+
+// spend takes one retry out of the shared budget, it returns false once the budget is exhausted
+func (g *retryGate) spend() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.tokens < 1 {
+		return false
+	}
+	g.tokens--
+	return true
+}
+
+// succeed slowly refills the budget, ten successful chunks buy one retry
+func (g *retryGate) succeed() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.tokens = min(g.tokens+0.1, g.maxTokens)
+}
@@ -0,0 +1,511 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+const defaultChunkSize = 2 * 1024 * 1024         // 2MB, for workers without a stable speed yet
+const chunkDuration = 2 * time.Second            // a stable worker gets about this much work per task
+const stableAfter = 5 * time.Second              // same grace period the health monitor gives a (re)started worker
+const defaultSequentialWindow = 64 * 1024 * 1024 // 64MB, a default sized task for every worker of a full pool
+
+// returned by chunkWriter.Write once another worker has taken the rest of the range
+var errRangeStolen = errors.New("rest of the range was taken by another worker")
+
+// task is the byte range a worker is downloading, its end moves down when an idle worker steals the tail
+type task struct {
+	id         int64
+	start      int64
+	done       int64 // everything before done is committed
+	pos        int64 // everything before pos is written or being written
+	end        int64 // exclusive
+	owner      *WorkerInfo
+	stolenFrom *WorkerInfo // owner of the task this one was split off, nil if it was not
+	dupOf      *task       // endgame duplicate of another worker's task
+	raced      bool        // an endgame duplicate of this task is in flight
+	cancel     context.CancelCauseFunc
+	sched      *scheduler
+}
+
+// scheduler hands out byte ranges to workers and lets idle workers split the slowest in-flight range
+type scheduler struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	free      rangeSet // ranges nobody is working on
+	inFlight  []*task
+	nextID    int64
+	chunkSize int64   // fixed task size, 0 sizes tasks by worker speed
+	demand    *demand // ranges readers of the partial file are waiting for, nil when nobody reads it
+	idle      int     // workers waiting for work
+	window    int64   // sequential mode: bytes past the frontier that work may start in, 0 when not sequential
+	closed    bool
+	finished  chan struct{} // closed once every range is done or the scheduler was closed
+}
+
+func newScheduler(missing rangeSet, chunkSize int64) *scheduler {
+	s := &scheduler{free: missing, chunkSize: chunkSize, finished: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mu)
+	s.checkFinished()
+	return s
+}
+
+// caller must hold the lock
+func (s *scheduler) checkFinished() {
+	if (s.closed || (len(s.free) == 0 && len(s.inFlight) == 0)) && !isClosed(s.finished) {
+		close(s.finished)
+	}
+}
+
+// next blocks until there is work for the worker, it returns false once everything is done
+// (an in-flight task can still come back through requeue so idle workers wait for those).
+// once nothing is left to hand out or split, idle workers race duplicates of the in-flight ranges
+func (s *scheduler) next(wi *WorkerInfo, workers int) (*task, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.closed {
+		if t := s.urgent(wi); t != nil {
+			return t, true
+		}
+		if t := s.takeover(wi); t != nil {
+			return t, true
+		}
+		if horizon := s.horizon(); len(s.free) > 0 && s.free[0].Start < horizon {
+			// in sequential mode the lowest ranges are left to the fast workers
+			if s.window > 0 && s.slow(wi) {
+				return s.takeLast(wi, s.taskSize(wi, workers), horizon), true
+			}
+			size := max(min(s.taskSize(wi, workers), horizon-s.free[0].Start), minChunkSize)
+			return s.take(wi, size), true
+		}
+		if t := s.steal(wi); t != nil {
+			return t, true
+		}
+		if t := s.duplicate(wi); t != nil {
+			return t, true
+		}
+		if len(s.inFlight) == 0 {
+			break
+		}
+		s.idle++
+		s.cond.Wait()
+		s.idle--
+	}
+	return nil, false
+}
+
+// taskSize grows the task for fast, stable workers and shrinks it near the tail, caller must hold the lock
+func (s *scheduler) taskSize(wi *WorkerInfo, workers int) int64 {
+	size := int64(defaultChunkSize)
+	if s.chunkSize > 0 {
+		size = s.chunkSize
+	} else if stats := wi.Snapshot(); stats.Speed > 0 && time.Since(stats.RestartedAt) > stableAfter {
+		size = int64(stats.Speed * chunkDuration.Seconds())
+	}
+	// split what is left so that every worker still gets a share at the end
+	if share := s.free.size() / int64(2*max(workers, 1)); size > share {
+		size = share
+	}
+	return min(max(size, minChunkSize), maxChunkSize)
+}
+
+// take cuts a task off the front of the first free range, caller must hold the lock
+func (s *scheduler) take(wi *WorkerInfo, size int64) *task {
+	r := s.free[0]
+	end := min(r.End, r.Start+size)
+	// a sliver left behind would cost a whole request on its own
+	if r.End-end < minChunkSize {
+		end = r.End
+	}
+	if end == r.End {
+		s.free = s.free[1:]
+	} else {
+		s.free[0].Start = end
+	}
+	return s.newTask(wi, r.Start, end)
+}
+
+// urgent hands out the free bytes a reader is blocked on, the task is kept small so it is committed
+// quickly. caller must hold the lock
+func (s *scheduler) urgent(wi *WorkerInfo) *task {
+	for _, want := range s.demand.wanted() {
+		for _, r := range s.free {
+			if r.End <= want.Start || r.Start >= want.End {
+				continue
+			}
+			start := max(r.Start, want.Start)
+			// a sliver left in front of it would cost a whole request on its own
+			if start-r.Start < minChunkSize {
+				start = r.Start
+			}
+			end := min(r.End, max(want.End, start+minChunkSize))
+			if r.End-end < minChunkSize {
+				end = r.End
+			}
+			s.free.remove(byteRange{start, end})
+			return s.newTask(wi, start, end)
+		}
+	}
+	return nil
+}
+
+// expedite cuts the in-flight tasks that hold bytes a reader is blocked on, a task is only committed
+// once its request is done. A task whose owner is still far from the bytes ends where they begin,
+// otherwise it ends a little past them. Either way the rest goes back to be handed out again.
+// Free bytes nobody is idle to take cut the task of the fastest worker short so it comes for them next
+func (s *scheduler) expedite() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, want := range s.demand.wanted() {
+		if s.idle == 0 && s.free.overlaps(want) {
+			if t := s.fastest(); t != nil {
+				s.cut(t, t.pos+minChunkSize)
+			}
+		}
+		for _, t := range s.inFlight {
+			if t.dupOf != nil || want.End <= t.done || want.Start >= t.end {
+				continue
+			}
+			cut := max(want.Start, t.done)
+			if cut < t.pos+minChunkSize {
+				cut = max(t.pos, want.End) + minChunkSize
+			}
+			s.cut(t, cut)
+		}
+	}
+	s.cond.Broadcast()
+}
+
+// fastest returns the task of the fastest worker that is not about to finish anyway, caller must hold the lock
+func (s *scheduler) fastest() *task {
+	var best *task
+	var bestSpeed float64
+	for _, t := range s.inFlight {
+		if t.dupOf != nil || t.end-t.pos < 2*minChunkSize {
+			continue
+		}
+		if speed := t.owner.Snapshot().Speed; best == nil || speed > bestSpeed {
+			best, bestSpeed = t, speed
+		}
+	}
+	return best
+}
+
+// cut ends the task at offset and frees the rest, unless that would leave a sliver. caller must hold the lock
+func (s *scheduler) cut(t *task, offset int64) {
+	if offset < t.pos || t.end-offset < minChunkSize {
+		return
+	}
+	s.free.add(byteRange{offset, t.end})
+	t.end = offset
+}
+
+// takeLast cuts a task off the end of the free bytes below limit, caller must hold the lock
+func (s *scheduler) takeLast(wi *WorkerInfo, size int64, limit int64) *task {
+	i := len(s.free) - 1
+	for s.free[i].Start >= limit {
+		i--
+	}
+	r := s.free[i]
+	end := min(r.End, limit)
+	start := max(r.Start, end-size)
+	// a sliver left in front of it would cost a whole request on its own
+	if start-r.Start < minChunkSize {
+		start = r.Start
+	}
+	s.free.remove(byteRange{start, end})
+	return s.newTask(wi, start, end)
+}
+
+// slow reports whether the worker is past its ramp up and less than half as fast as the fastest
+// worker with a task, caller must hold the lock
+func (s *scheduler) slow(wi *WorkerInfo) bool {
+	stats := wi.Snapshot()
+	if time.Since(stats.RestartedAt) < stableAfter {
+		return false
+	}
+	var fastest float64
+	for _, t := range s.inFlight {
+		fastest = max(fastest, t.owner.Snapshot().Speed)
+	}
+	return stats.Speed < fastest/2
+}
+
+// steal splits the in-flight task that will take the longest to finish and hands out its second half,
+// caller must hold the lock
+func (s *scheduler) steal(wi *WorkerInfo) *task {
+	var victim *task
+	var worst float64
+	speed := wi.Snapshot().Speed
+	horizon := s.horizon()
+	for _, t := range s.inFlight {
+		left := t.end - t.pos
+		if left < 2*minChunkSize || t.pos+left/2 >= horizon {
+			continue
+		}
+		// a much slower worker would finish its half after the owner would have finished the whole
+		ownerSpeed := t.owner.Snapshot().Speed
+		if speed > 0 && ownerSpeed > 0 && 2*speed < ownerSpeed {
+			continue
+		}
+		eta := math.Inf(1) // no speed sample yet, probably stuck
+		if ownerSpeed > 0 {
+			eta = float64(left) / ownerSpeed
+		}
+		if victim == nil || eta > worst {
+			victim, worst = t, eta
+		}
+	}
+	if victim == nil {
+		return nil
+	}
+
+	mid := victim.pos + (victim.end-victim.pos)/2
+	t := s.newTask(wi, mid, victim.end)
+	t.stolenFrom = victim.owner
+	victim.end = mid
+	return t
+}
+
+// frontier is the first byte that is not committed yet, everything before it is on disk. caller must hold the lock
+func (s *scheduler) frontier() int64 {
+	front := int64(math.MaxInt64)
+	if len(s.free) > 0 {
+		front = s.free[0].Start
+	}
+	for _, t := range s.inFlight {
+		front = min(front, t.done)
+	}
+	return front
+}
+
+// horizon is where sequential mode stops handing out work, caller must hold the lock
+func (s *scheduler) horizon() int64 {
+	if s.window <= 0 {
+		return math.MaxInt64
+	}
+	return s.frontier() + s.window
+}
+
+// takeover hands the rest of the task at the frontier to a worker at least twice as fast as its owner
+// in sequential mode, the owner only finishes the bit it is on. caller must hold the lock
+func (s *scheduler) takeover(wi *WorkerInfo) *task {
+	if s.window <= 0 {
+		return nil
+	}
+	var front *task
+	for _, t := range s.inFlight {
+		if t.dupOf == nil && (front == nil || t.done < front.done) {
+			front = t
+		}
+	}
+	if front == nil || front.owner == wi || front.end-front.pos < 2*minChunkSize {
+		return nil
+	}
+	// a free range in front of it is handed out in order anyway
+	if len(s.free) > 0 && s.free[0].Start < front.done {
+		return nil
+	}
+	// the owner's smoothed speed survives a restart, so a worker restarted for being slow still looks slow
+	stats := wi.Snapshot()
+	if stats.Speed <= 0 || time.Since(stats.RestartedAt) < stableAfter || stats.Speed < 2*front.owner.Snapshot().Speed {
+		return nil
+	}
+
+	cut := front.pos + minChunkSize
+	t := s.newTask(wi, cut, front.end)
+	t.stolenFrom = front.owner
+	front.end = cut
+	return t
+}
+
+// duplicate starts an endgame race against the in-flight task that will take the longest to finish,
+// every task gets at most one duplicate so idle workers spread over the stragglers. In sequential mode
+// a worker held back by the window only races the task at the frontier, caller must hold the lock
+func (s *scheduler) duplicate(wi *WorkerInfo) *task {
+	if s.window > 0 && len(s.free) > 0 {
+		return s.raceFrontier(wi)
+	}
+	var victim *task
+	var worst float64
+	for _, t := range s.inFlight {
+		if t.raced || t.dupOf != nil || t.owner == wi || t.pos >= t.end {
+			continue
+		}
+		eta := math.Inf(1)
+		if ownerSpeed := t.owner.Snapshot().Speed; ownerSpeed > 0 {
+			eta = float64(t.end-t.pos) / ownerSpeed
+		}
+		if victim == nil || eta > worst {
+			victim, worst = t, eta
+		}
+	}
+	if victim == nil {
+		return nil
+	}
+
+	t := s.newTask(wi, victim.pos, victim.end)
+	t.dupOf = victim
+	victim.raced = true
+	return t
+}
+
+// raceFrontier duplicates the task at the frontier unless it is raced already, caller must hold the lock
+func (s *scheduler) raceFrontier(wi *WorkerInfo) *task {
+	var front *task
+	for _, t := range s.inFlight {
+		if t.dupOf == nil && (front == nil || t.done < front.done) {
+			front = t
+		}
+	}
+	if front == nil || front.raced || front.owner == wi || front.pos >= front.end {
+		return nil
+	}
+
+	t := s.newTask(wi, front.pos, front.end)
+	t.dupOf = front
+	front.raced = true
+	return t
+}
+
+// caller must hold the lock
+func (s *scheduler) newTask(wi *WorkerInfo, start int64, end int64) *task {
+	t := &task{
+		id:    s.nextID,
+		start: start,
+		done:  start,
+		pos:   start,
+		end:   end,
+		owner: wi,
+		sched: s,
+	}
+	s.nextID++
+	s.inFlight = append(s.inFlight, t)
+	return t
+}
+
+// caller must hold the lock
+func (s *scheduler) drop(t *task) {
+	if t.dupOf != nil {
+		// the task can be raced again if it is still around
+		t.dupOf.raced = false
+	}
+	for i, other := range s.inFlight {
+		if other == t {
+			s.inFlight = append(s.inFlight[:i], s.inFlight[i+1:]...)
+			return
+		}
+	}
+}
+
+// finish removes a task that is done (or failed for good), tasks racing it for the same bytes
+// stop where its range begins and are cancelled if that leaves them nothing to do
+func (s *scheduler) finish(t *task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.drop(t)
+	if t.done >= t.end {
+		for _, other := range s.inFlight {
+			if other.end <= t.start || other.end > t.end {
+				continue
+			}
+			other.end = max(other.pos, t.start)
+			if other.end == other.pos && other.cancel != nil {
+				other.cancel(errRaceLost)
+			}
+		}
+	}
+	s.checkFinished()
+	s.cond.Broadcast()
+}
+
+// requeue gives the uncommitted rest of a task back so it is picked up next
+func (s *scheduler) requeue(t *task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.drop(t)
+	s.free.add(byteRange{t.done, t.end})
+	s.checkFinished()
+	s.cond.Broadcast()
+}
+
+// remaining returns the number of bytes that are free or in flight but not committed yet
+func (s *scheduler) remaining() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := s.free.size()
+	for _, t := range s.inFlight {
+		total += t.end - t.done
+	}
+	return total
+}
+
+// close wakes up every waiting worker and stops handing out work
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.checkFinished()
+	s.cond.Broadcast()
+}
+
+// bounds returns where the next request of the task has to start and end (exclusive)
+func (t *task) bounds() (int64, int64) {
+	t.sched.mu.Lock()
+	defer t.sched.mu.Unlock()
+
+	t.pos = t.done
+	return t.done, t.end
+}
+
+// reserve returns how many of n bytes starting at offset still belong to the task
+func (t *task) reserve(offset int64, n int64) int64 {
+	t.sched.mu.Lock()
+	defer t.sched.mu.Unlock()
+
+	allowed := min(max(t.end-offset, 0), n)
+	t.pos = max(t.pos, offset+allowed)
+	return allowed
+}
+
+// commit marks the next n bytes of the task as committed and returns their range
+func (t *task) commit(n int64) byteRange {
+	t.sched.mu.Lock()
+	defer t.sched.mu.Unlock()
+
+	r := byteRange{t.done, t.done + n}
+	t.done += n
+	t.pos = max(t.pos, t.done)
+	return r
+}
+
+func (t *task) setCancel(cancel context.CancelCauseFunc) {
+	t.sched.mu.Lock()
+	defer t.sched.mu.Unlock()
+	t.cancel = cancel
+}
+
+// limit returns the current end of the task (exclusive)
+func (t *task) limit() int64 {
+	t.sched.mu.Lock()
+	defer t.sched.mu.Unlock()
+	return t.end
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
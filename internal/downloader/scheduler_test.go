@@ -0,0 +1,648 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+)
+
+const mib = 1024 * 1024
+
+func TestSchedulerHandsOutEveryByteOnce(t *testing.T) {
+	tests := []struct {
+		name      string
+		missing   rangeSet
+		chunkSize int64
+		workers   int
+	}{
+		{"one range", rangeSet{{0, 64 * mib}}, 4 * mib, 4},
+		{"uneven tail", rangeSet{{0, 10*mib + 100}}, 4 * mib, 2},
+		{"tail smaller than a chunk", rangeSet{{0, 4*mib + minChunkSize/2}}, 4 * mib, 1},
+		{"resumed holes", rangeSet{{mib, 3 * mib}, {10 * mib, 10*mib + 1000}, {20 * mib, 40 * mib}}, 2 * mib, 4},
+		{"sized by speed", rangeSet{{0, 100 * mib}}, 0, 8},
+		{"single byte", rangeSet{{41, 42}}, 4 * mib, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(slices.Clone(tt.missing), tt.chunkSize)
+			workers := newTestWorkers(tt.workers)
+
+			var handedOut rangeSet
+			for i := 0; len(s.free) > 0; i++ {
+				tk, ok := s.next(workers[i%len(workers)], len(workers))
+				if !ok {
+					t.Fatal("next returned no task while ranges were free")
+				}
+				r := byteRange{tk.start, tk.end}
+				if added := handedOut.add(r); added != r.size() {
+					t.Fatalf("%v was handed out twice, already handed out %v", r, handedOut)
+				}
+				checkCoverage(t, s, nil, tt.missing)
+			}
+			if !slices.Equal(handedOut, tt.missing) {
+				t.Errorf("handed out %v, want %v", handedOut, tt.missing)
+			}
+		})
+	}
+}
+
+func TestSchedulerSteal(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int64
+		reserved   int64 // bytes the owner has read ahead of what it committed
+		committed  int64
+		wantSplit  int64 // where the victim ends and the stolen task begins, 0 if nothing can be stolen
+		wantRacing bool  // the idle worker races a duplicate instead
+	}{
+		{"untouched task", 8 * mib, 0, 0, 4 * mib, false},
+		{"half committed", 8 * mib, 0, 4 * mib, 6 * mib, false},
+		{"bytes in flight are not stolen", 8 * mib, 2 * mib, 0, 5 * mib, false},
+		{"too small to split", 2*minChunkSize - 1, 0, 0, 0, true},
+		{"almost done", 8 * mib, 0, 8*mib - minChunkSize, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full := rangeSet{{0, tt.size}}
+			s := newScheduler(slices.Clone(full), tt.size)
+			workers := newTestWorkers(2)
+
+			var committed rangeSet
+			owner := takeAll(s, workers[0])
+			commitTask(t, owner, tt.committed, &committed)
+			if tt.reserved > 0 {
+				owner.reserve(owner.done, tt.reserved)
+			}
+
+			thief, ok := s.next(workers[1], len(workers))
+			if !ok {
+				t.Fatal("next returned no task for the idle worker")
+			}
+			if tt.wantRacing {
+				if thief.dupOf != owner {
+					t.Fatalf("idle worker got %d-%d, want a duplicate of the owner's task", thief.start, thief.end)
+				}
+				return
+			}
+			if thief.dupOf != nil || thief.stolenFrom != workers[0] {
+				t.Fatalf("idle worker did not steal from the owner")
+			}
+			if owner.end != tt.wantSplit || thief.start != tt.wantSplit || thief.end != tt.size {
+				t.Errorf("split into %d-%d and %d-%d, want the split at %d", owner.start, owner.end, thief.start, thief.end, tt.wantSplit)
+			}
+			checkCoverage(t, s, committed, full)
+
+			drain(t, s, &committed, len(workers), owner, thief)
+			if !slices.Equal(committed, full) {
+				t.Errorf("committed %v, want %v", committed, full)
+			}
+		})
+	}
+}
+
+func TestSchedulerExpedite(t *testing.T) {
+	const size = 8 * mib
+	tests := []struct {
+		name     string
+		reserved int64 // how far the owner has read
+		done     int64 // how much the owner has committed
+		want     byteRange
+		wantEnd  int64
+	}{
+		{"owner far from the bytes", 0, 0, byteRange{4 * mib, 5 * mib}, 4 * mib},
+		{"owner close to the bytes", 4*mib - 100, 0, byteRange{4 * mib, 5 * mib}, 5*mib + minChunkSize},
+		{"owner past the bytes", 0, 3 * mib, byteRange{mib, 2 * mib}, size},
+		{"cut would leave a sliver", 0, 0, byteRange{size - 100, size}, size},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full := rangeSet{{0, size}}
+			s := newScheduler(slices.Clone(full), size)
+			s.demand = newDemand()
+			workers := newTestWorkers(2)
+
+			var committed rangeSet
+			owner := takeAll(s, workers[0])
+			commitTask(t, owner, tt.done, &committed)
+			if tt.reserved > 0 {
+				owner.reserve(owner.done, tt.reserved)
+			}
+
+			s.demand.want(tt.want)
+			s.expedite()
+			if owner.end != tt.wantEnd {
+				t.Errorf("task ends at %d after expedite, want %d", owner.end, tt.wantEnd)
+			}
+			checkCoverage(t, s, committed, full)
+
+			tasks := []*task{owner}
+			if s.free.overlaps(tt.want) {
+				// the wanted bytes that were cut off go to the next idle worker before anything else
+				urgent, _ := s.next(workers[1], len(workers))
+				if urgent.start > tt.want.Start || urgent.end <= tt.want.Start {
+					t.Errorf("idle worker got %d-%d, want the bytes from %d on", urgent.start, urgent.end, tt.want.Start)
+				}
+				tasks = append(tasks, urgent)
+				checkCoverage(t, s, committed, full)
+			}
+
+			drain(t, s, &committed, len(workers), tasks...)
+			if !slices.Equal(committed, full) {
+				t.Errorf("committed %v, want %v", committed, full)
+			}
+		})
+	}
+}
+
+func TestSchedulerRequeue(t *testing.T) {
+	const size = 8 * mib
+	tests := []struct {
+		name      string
+		committed int64
+		stolen    bool // another worker stole the second half before the owner gave up
+		wantFree  rangeSet
+	}{
+		{"nothing committed", 0, false, rangeSet{{0, size}}},
+		{"partly committed", 3 * mib, false, rangeSet{{3 * mib, size}}},
+		{"one byte short", size - 1, false, rangeSet{{size - 1, size}}},
+		{"after a steal", mib, true, rangeSet{{mib, size / 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full := rangeSet{{0, size}}
+			s := newScheduler(slices.Clone(full), size)
+			workers := newTestWorkers(3)
+
+			var committed rangeSet
+			tasks := []*task{}
+			owner := takeAll(s, workers[0])
+			if tt.stolen {
+				thief, _ := s.next(workers[1], len(workers))
+				tasks = append(tasks, thief)
+			}
+			commitTask(t, owner, tt.committed, &committed)
+
+			s.requeue(owner)
+			if !slices.Equal(s.free, tt.wantFree) {
+				t.Errorf("free after requeue = %v, want %v", s.free, tt.wantFree)
+			}
+			checkCoverage(t, s, committed, full)
+
+			again, ok := s.next(workers[2], len(workers))
+			if !ok || again.start != tt.wantFree[0].Start {
+				t.Fatalf("the requeued bytes were not handed out again")
+			}
+			tasks = append(tasks, again)
+			drain(t, s, &committed, len(workers), tasks...)
+			if !slices.Equal(committed, full) {
+				t.Errorf("committed %v, want %v", committed, full)
+			}
+		})
+	}
+}
+
+func TestSchedulerFinishRace(t *testing.T) {
+	const size = minChunkSize + 1000 // too small to steal from, so the idle worker races it
+
+	tests := []struct {
+		name          string
+		duplicateWins bool
+		loserDone     int64 // bytes the loser committed before the winner finished
+	}{
+		{"owner wins", false, 0},
+		{"duplicate wins", true, 0},
+		{"owner wins against a started duplicate", false, 1000},
+		{"duplicate wins against a started owner", true, 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(rangeSet{{0, size}}, size)
+			workers := newTestWorkers(2)
+
+			owner := takeAll(s, workers[0])
+			dup, _ := s.next(workers[1], len(workers))
+			if dup.dupOf != owner || !owner.raced {
+				t.Fatalf("idle worker got %d-%d, want a duplicate of the owner's task", dup.start, dup.end)
+			}
+
+			winner, loser := owner, dup
+			if tt.duplicateWins {
+				winner, loser = dup, owner
+			}
+			ctx, cancel := context.WithCancelCause(context.Background())
+			defer cancel(nil)
+			loser.setCancel(cancel)
+
+			var committed, loserCommitted rangeSet
+			commitTask(t, loser, tt.loserDone, &loserCommitted)
+			commitTask(t, winner, size, &committed)
+			s.finish(winner)
+
+			if loser.limit() != loser.pos {
+				t.Errorf("loser still has %d-%d to do after the race was decided", loser.pos, loser.limit())
+			}
+			if !errors.Is(context.Cause(ctx), errRaceLost) {
+				t.Errorf("loser was cancelled with %v, want %v", context.Cause(ctx), errRaceLost)
+			}
+			s.finish(loser)
+
+			if !isClosed(s.finished) || s.remaining() != 0 {
+				t.Errorf("scheduler did not finish after the race, %d bytes remaining", s.remaining())
+			}
+			if !slices.Equal(committed, rangeSet{{0, size}}) {
+				t.Errorf("winner committed %v, want all of it", committed)
+			}
+		})
+	}
+}
+
+func TestSchedulerDuplicateGivesUp(t *testing.T) {
+	const size = minChunkSize + 1000
+	s := newScheduler(rangeSet{{0, size}}, size)
+	workers := newTestWorkers(3)
+
+	owner := takeAll(s, workers[0])
+	dup, _ := s.next(workers[1], len(workers))
+	s.finish(dup)
+
+	if owner.raced || owner.end != size {
+		t.Fatalf("a failed duplicate cut the owner's task to %d-%d", owner.start, owner.end)
+	}
+	// the task can be raced again
+	s.mu.Lock()
+	again := s.duplicate(workers[2])
+	s.mu.Unlock()
+	if again == nil || again.dupOf != owner {
+		t.Errorf("the task was not raced again after its duplicate failed")
+	}
+}
+
+// every byte is committed exactly once however the work is split, given back, cut short and stolen
+func TestSchedulerNeverLosesBytes(t *testing.T) {
+	tests := []struct {
+		seed      uint64
+		missing   rangeSet
+		chunkSize int64
+		workers   int
+	}{
+		{1, rangeSet{{0, 16 * mib}}, mib, 4},
+		{2, rangeSet{{0, 16 * mib}}, 0, 8},
+		{3, rangeSet{{100, 3 * mib}, {5 * mib, 9*mib + 7}}, minChunkSize, 3},
+		{4, rangeSet{{0, 4 * mib}}, 4 * mib, 2},
+		{5, rangeSet{{0, 32*mib + 1}}, 2 * mib, 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("seed %d", tt.seed), func(t *testing.T) {
+			rng := rand.New(rand.NewPCG(tt.seed, tt.seed))
+			s := newScheduler(slices.Clone(tt.missing), tt.chunkSize)
+			workers := newTestWorkers(tt.workers)
+			tasks := make([]*task, len(workers))
+
+			var committed rangeSet
+			for step := 0; !isClosed(s.finished); step++ {
+				if step > 1_000_000 {
+					t.Fatalf("not done after %d steps, %d bytes remaining", step, s.remaining())
+				}
+				i := rng.IntN(len(workers))
+				tk := tasks[i]
+				switch {
+				case tk == nil:
+					if tk, ok := nextOrSteal(s, workers[i], len(workers)); ok {
+						tasks[i] = tk
+					}
+				case tk.done >= tk.limit():
+					s.finish(tk)
+					tasks[i] = nil
+				case rng.IntN(20) == 0:
+					s.requeue(tk)
+					tasks[i] = nil
+				case rng.IntN(20) == 0:
+					s.mu.Lock()
+					s.cut(tk, tk.pos+rng.Int64N(tk.end-tk.pos+1))
+					s.mu.Unlock()
+				default:
+					commitTask(t, tk, rng.Int64N(2*minChunkSize)+1, &committed)
+				}
+				checkCoverage(t, s, committed, tt.missing)
+			}
+
+			if !slices.Equal(committed, tt.missing) {
+				t.Errorf("committed %v, want %v", committed, tt.missing)
+			}
+		})
+	}
+}
+
+func TestSequentialFastWorkerGetsLowestRanges(t *testing.T) {
+	const window = 16 * mib
+	tests := []struct {
+		name        string
+		fastSpeed   float64
+		slowSpeed   float64
+		slowStable  bool // the slow worker is past its ramp up
+		wantAtFront bool // the slow worker still gets the lowest free range
+	}{
+		{"much slower worker", 10 * mib, 1 * mib, true, false},
+		{"slightly slower worker", 10 * mib, 6 * mib, true, true},
+		{"slow worker still ramping up", 10 * mib, 1 * mib, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full := rangeSet{{0, 64 * mib}}
+			s := newScheduler(slices.Clone(full), 2*mib)
+			s.window = window
+			workers := newTestWorkers(2)
+			fast, slow := workers[0], workers[1]
+			setSpeed(fast, tt.fastSpeed, true)
+			setSpeed(slow, tt.slowSpeed, tt.slowStable)
+
+			first, _ := s.next(fast, len(workers))
+			slowTask, _ := s.next(slow, len(workers))
+			second, _ := s.next(fast, len(workers))
+
+			if first.start != 0 {
+				t.Errorf("fast worker started at %d, want 0", first.start)
+			}
+			if tt.wantAtFront {
+				if slowTask.start != first.end || second.start != slowTask.end {
+					t.Errorf("got %d-%d, %d-%d and %d-%d, want them in order", first.start, first.end, slowTask.start, slowTask.end, second.start, second.end)
+				}
+			} else {
+				// the slow worker works at the edge of the window, the fast one keeps going from the front
+				if slowTask.end != window || second.start != first.end {
+					t.Errorf("slow worker got %d-%d and fast worker %d-%d, want the slow one at the end of the window", slowTask.start, slowTask.end, second.start, second.end)
+				}
+			}
+			checkCoverage(t, s, nil, full)
+		})
+	}
+}
+
+func TestSequentialStaysInsideWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int64
+		window    int64
+		chunkSize int64
+		workers   int
+	}{
+		{"window of a few chunks", 32 * mib, 4 * mib, mib, 4},
+		{"window smaller than a chunk", 16 * mib, 2 * mib, 4 * mib, 2},
+		{"window larger than the file", 8 * mib, 64 * mib, mib, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full := rangeSet{{0, tt.size}}
+			s := newScheduler(slices.Clone(full), tt.chunkSize)
+			s.window = tt.window
+			workers := newTestWorkers(tt.workers)
+
+			var committed rangeSet
+			var tasks []*task
+			for step := 0; !isClosed(s.finished); step++ {
+				if step > 10_000 {
+					t.Fatalf("not done after %d steps, %d bytes remaining", step, s.remaining())
+				}
+				s.mu.Lock()
+				horizon := s.horizon()
+				canTake := len(s.free) > 0 && s.free[0].Start < horizon
+				s.mu.Unlock()
+
+				if canTake && len(tasks) < len(workers) {
+					tk, _ := s.next(workers[len(tasks)], len(workers))
+					if tk.start >= horizon {
+						t.Fatalf("task %d-%d starts past the frontier plus the window at %d", tk.start, tk.end, horizon)
+					}
+					tasks = append(tasks, tk)
+				} else {
+					// the task at the frontier is done, which moves the window on
+					slices.SortFunc(tasks, func(a, b *task) int { return int(a.done - b.done) })
+					commitTask(t, tasks[0], tasks[0].limit(), &committed)
+					s.finish(tasks[0])
+					tasks = tasks[1:]
+				}
+				checkCoverage(t, s, committed, full)
+			}
+			if !slices.Equal(committed, full) {
+				t.Errorf("committed %v, want %v", committed, full)
+			}
+		})
+	}
+}
+
+func TestSequentialTakeover(t *testing.T) {
+	const size = 8 * mib
+	tests := []struct {
+		name         string
+		ownerSpeed   float64
+		fastSpeed    float64
+		fastStable   bool
+		ownerDone    int64
+		wantTakeover bool
+	}{
+		{"twice as fast", 1 * mib, 10 * mib, true, 0, true},
+		{"twice as fast after a partial commit", 1 * mib, 10 * mib, true, 3 * mib, true},
+		{"not twice as fast", 1 * mib, 1.5 * mib, true, 0, false},
+		{"fast worker still ramping up", 1 * mib, 10 * mib, false, 0, false},
+		{"frontier task almost done", 1 * mib, 10 * mib, true, size - minChunkSize, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full := rangeSet{{0, 4 * size}}
+			s := newScheduler(slices.Clone(full), size)
+			s.window = 4 * size
+			workers := newTestWorkers(2)
+			owner, fast := workers[0], workers[1]
+			setSpeed(owner, tt.ownerSpeed, true)
+			setSpeed(fast, tt.fastSpeed, tt.fastStable)
+
+			var committed rangeSet
+			s.mu.Lock()
+			front := s.take(owner, size)
+			s.mu.Unlock()
+			commitTask(t, front, tt.ownerDone, &committed)
+
+			got, _ := s.next(fast, len(workers))
+			if tt.wantTakeover {
+				cut := tt.ownerDone + minChunkSize
+				if got.stolenFrom != owner || got.start != cut || got.end != size || front.end != cut {
+					t.Errorf("fast worker got %d-%d and the owner kept %d-%d, want the split at %d", got.start, got.end, front.start, front.end, cut)
+				}
+			} else if got.stolenFrom != nil || got.start != size {
+				t.Errorf("fast worker got %d-%d, want the next free range from %d", got.start, got.end, int64(size))
+			}
+			checkCoverage(t, s, committed, full)
+		})
+	}
+}
+
+func TestSequentialRacesOnlyFrontier(t *testing.T) {
+	const taskSize = minChunkSize + 1000 // too small to steal or take over
+	tests := []struct {
+		name       string
+		finished   int   // tasks at the front that are done before the idle workers ask
+		raced      []int // tasks raced already, by index
+		idle       int   // index of the worker that asks, it owns the task of the same index if there is one
+		wantRaceOf int   // index of the task that gets a duplicate, -1 for none
+	}{
+		{"frontier task", 0, nil, 3, 0},
+		{"frontier moved on", 1, nil, 3, 1},
+		{"frontier raced already", 0, []int{0}, 3, -1},
+		{"owner of the frontier", 0, nil, 0, -1},
+		{"owner of a task behind the frontier", 0, nil, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(rangeSet{{0, 64 * mib}}, taskSize)
+			s.window = 3 * taskSize
+			workers := newTestWorkers(4)
+
+			s.mu.Lock()
+			var tasks []*task
+			for i := range 3 {
+				tasks = append(tasks, s.take(workers[i], taskSize))
+			}
+			for _, i := range tt.raced {
+				tasks[i].raced = true
+			}
+			s.mu.Unlock()
+
+			var committed rangeSet
+			for _, tk := range tasks[:tt.finished] {
+				commitTask(t, tk, taskSize, &committed)
+				s.finish(tk)
+			}
+
+			s.mu.Lock()
+			dup := s.duplicate(workers[tt.idle])
+			s.mu.Unlock()
+
+			switch {
+			case tt.wantRaceOf < 0 && dup != nil:
+				t.Errorf("worker %d raced %d-%d, want no race", tt.idle, dup.start, dup.end)
+			case tt.wantRaceOf >= 0 && (dup == nil || dup.dupOf != tasks[tt.wantRaceOf]):
+				t.Errorf("worker %d did not race task %d at the frontier", tt.idle, tt.wantRaceOf)
+			}
+		})
+	}
+}
+
+// <== Helper Functions ==>
+
+func newTestWorkers(n int) []*WorkerInfo {
+	workers := make([]*WorkerInfo, n)
+	for i := range workers {
+		workers[i] = newWorkerInfo(i)
+	}
+	return workers
+}
+
+// takeAll hands all of the first free range to wi, next would only hand out a share of it
+func takeAll(s *scheduler, wi *WorkerInfo) *task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.take(wi, s.free[0].size())
+}
+
+// nextOrSteal hands wi a free range or the stolen half of another task, unlike next it does not block
+// when there is neither
+func nextOrSteal(s *scheduler, wi *WorkerInfo, workers int) (*task, bool) {
+	s.mu.Lock()
+	free := len(s.free) > 0
+	s.mu.Unlock()
+	if free {
+		return s.next(wi, workers)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.steal(wi)
+	return t, t != nil
+}
+
+// commitTask commits up to n bytes of tk the way a worker does and records them in committed,
+// a byte committed twice means it was handed out twice
+func commitTask(t *testing.T, tk *task, n int64, committed *rangeSet) {
+	t.Helper()
+	start, end := tk.bounds()
+	r := tk.commit(tk.reserve(start, min(n, end-start)))
+	if added := committed.add(r); added != r.size() {
+		t.Fatalf("task %d committed %v twice", tk.id, r)
+	}
+}
+
+// drain commits and finishes the rest of every task, then works off whatever is still free.
+// The scheduler has to be done afterwards
+func drain(t *testing.T, s *scheduler, committed *rangeSet, workers int, tasks ...*task) {
+	t.Helper()
+	wi := newWorkerInfo(workers)
+	for {
+		for _, tk := range tasks {
+			commitTask(t, tk, tk.limit(), committed)
+			s.finish(tk)
+		}
+		if isClosed(s.finished) {
+			return
+		}
+		tk, ok := nextOrSteal(s, wi, workers)
+		if !ok {
+			t.Fatalf("scheduler is stuck with %d bytes remaining", s.remaining())
+		}
+		tasks = []*task{tk}
+	}
+}
+
+// checkCoverage fails unless the committed bytes, the free ranges and the uncommitted rest of every task
+// that is not an endgame duplicate make up want without overlapping
+func checkCoverage(t *testing.T, s *scheduler, committed rangeSet, want rangeSet) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := slices.Clone(committed)
+	add := func(what string, r byteRange) {
+		if r.End < r.Start {
+			t.Fatalf("%s %v is inverted", what, r)
+		}
+		if r.End > r.Start && all.overlaps(r) {
+			t.Fatalf("%s %v is handed out twice, already have %v", what, r, all)
+		}
+		all.add(r)
+	}
+	for _, r := range s.free {
+		add("free range", r)
+	}
+	for _, tk := range s.inFlight {
+		if tk.dupOf == nil {
+			add(fmt.Sprintf("task %d", tk.id), byteRange{tk.done, tk.end})
+		}
+	}
+	if !slices.Equal(all, want) {
+		t.Fatalf("committed, free and in-flight bytes are %v, want %v", all, want)
+	}
+}
+
+// setSpeed gives wi a smoothed speed, a stable worker is past its ramp up
+func setSpeed(wi *WorkerInfo, speed float64, stable bool) {
+	wi.mu.Lock()
+	defer wi.mu.Unlock()
+	wi.speed = speed
+	wi.restartedAt = time.Now()
+	if stable {
+		wi.restartedAt = wi.restartedAt.Add(-2 * stableAfter)
+	}
+}
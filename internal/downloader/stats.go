@@ -0,0 +1,47 @@
+package downloader
+
+// DownloadSnapshot is a copy of the download's statistics, safe to keep and read from any goroutine
+type DownloadSnapshot struct {
+	Workers       []WorkerSnapshot // every worker up to the limit, parked ones included
+	BytesWritten  int64            // committed bytes, including what a resumed download started with
+	TotalSize     int64
+	ActiveWorkers int
+	WorkerLimit   int
+	BaselineSpeed float64  // speed the health policy expects of a healthy worker
+	Mirrors       []Mirror // the primary URL first
+}
+
+// Snapshot collects the statistics of the download and all of its workers, the UI, telemetry and
+// health monitor only ever look at these so they never race the workers
+func (rdi *RangeDownloadInfo) Snapshot() DownloadSnapshot {
+	rdi.poolMu.Lock()
+	snapshot := DownloadSnapshot{
+		Workers:       make([]WorkerSnapshot, len(rdi.Workers.Slice)),
+		BytesWritten:  rdi.BytesWritten.Load(),
+		TotalSize:     rdi.TotalSize,
+		ActiveWorkers: rdi.activeWorkers(),
+		WorkerLimit:   rdi.Workers.Limit,
+		BaselineSpeed: rdi.baseline,
+	}
+	for i, wi := range rdi.Workers.Slice {
+		snapshot.Workers[i] = wi.Snapshot()
+	}
+	rdi.poolMu.Unlock()
+
+	if rdi.Mirrors != nil {
+		snapshot.Mirrors = rdi.Mirrors.Snapshot()
+	}
+	return snapshot
+}
+
+func (rdi *RangeDownloadInfo) baselineSpeed() float64 {
+	rdi.poolMu.Lock()
+	defer rdi.poolMu.Unlock()
+	return rdi.baseline
+}
+
+func (rdi *RangeDownloadInfo) setBaselineSpeed(speed float64) {
+	rdi.poolMu.Lock()
+	defer rdi.poolMu.Unlock()
+	rdi.baseline = speed
+}
@@ -0,0 +1,335 @@
+package downloader
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// StreamDownloadInfo describes a download from a server without range support (or one that does not say
+// how big the file is), fetched in a single request that is resumed or started over when it breaks
+type StreamDownloadInfo struct {
+	URL            url.URL
+	Filename       string      // empty to name the file after the response
+	DirName        string      // holds the trace log and telemetry, set when StatusFlags asks for them
+	Writer         io.Writer   // written to instead of a file when set, a broken stream can then only be resumed
+	Header         http.Header // sent with every request, Range and If-Range are set by the download itself
+	StatusFlags    StatusFlags
+	Checksum       *ChecksumInfo // hashed while the bytes stream in
+	Validators     Validators    // a resumed request only continues the file it started with
+	RetryPolicy    RetryPolicy   // Budget is not used, a stream has a single connection
+	Timeouts       Timeouts
+	DiscardPartial bool // delete the file of a stream that did not finish instead of keeping it
+	Events         *EventBus
+	bytesWritten   atomic.Int64
+	totalSize      atomic.Int64
+}
+
+// InitStreamDownloadInfo prepares a stream of reqURL to filename, which moves into a directory of its own
+// like the one of a range download when a trace log or telemetry are written
+func InitStreamDownloadInfo(filename string, reqURL string, validators Validators, statusFlags StatusFlags) (*StreamDownloadInfo, error) {
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return nil, err
+	}
+	filename, dirName, err := statusDir(filename, statusFlags)
+	if err != nil {
+		return nil, err
+	}
+
+	sdi := &StreamDownloadInfo{
+		URL:         *u,
+		Filename:    filename,
+		DirName:     dirName,
+		StatusFlags: statusFlags,
+		Validators:  validators,
+		RetryPolicy: DefaultRetryPolicy,
+		Timeouts:    DefaultTimeouts,
+		Events:      NewEventBus(),
+	}
+	sdi.totalSize.Store(-1)
+	return sdi, nil
+}
+
+// StreamDownload fetches the file in a single request for servers without range support, it reports
+// through sdi.Events the same way RangeDownload does
+func (sdi *StreamDownloadInfo) StreamDownload(ctx context.Context) error {
+	// the trace log and telemetry are subscribers like any other, they are flushed before returning
+	if sdi.StatusFlags.EnableTrace {
+		trace, err := newTraceLog(filepath.Join(sdi.DirName, "httptrace.log"))
+		if err != nil {
+			sdi.Events.publish(Failed{EventMeta: meta(-1, -1), Err: err})
+			return err
+		}
+		defer trace.close()
+		defer sdi.Events.Subscribe(trace)()
+	}
+	if sdi.StatusFlags.EnableTelemetry {
+		defer sdi.Events.Subscribe(newTelemetryRecorder(sdi.DirName, sdi.Snapshot))()
+	}
+
+	start := time.Now()
+	n, err := sdi.streamDownload(ctx)
+	if err != nil {
+		sdi.Events.publish(Failed{EventMeta: meta(-1, -1), Err: err})
+		return err
+	}
+	sdi.Events.publish(Completed{EventMeta: meta(-1, -1), Bytes: n, Elapsed: time.Since(start)})
+	return nil
+}
+
+// Snapshot reports the bytes written so far, a stream has no worker statistics
+func (sdi *StreamDownloadInfo) Snapshot() DownloadSnapshot {
+	return DownloadSnapshot{
+		BytesWritten:  sdi.bytesWritten.Load(),
+		TotalSize:     sdi.totalSize.Load(),
+		ActiveWorkers: 1,
+		WorkerLimit:   1,
+	}
+}
+
+// <== Helper Functions ==>
+
+func (sdi *StreamDownloadInfo) streamDownload(ctx context.Context) (int64, error) {
+	policy := sdi.RetryPolicy
+	client := newWorkerClient(sdi.Timeouts)
+
+	t := &streamTarget{filename: sdi.Filename, dst: sdi.Writer}
+	if sdi.Checksum != nil {
+		t.hash = sdi.Checksum.Algo.NewHash()
+	}
+	defer t.close()
+
+	failed := func(reason error) (int64, error) {
+		return t.written, sdi.cleanupPartial(t, reason)
+	}
+
+	for attempt, id := 0, int64(0); ; id++ {
+		written := t.written
+		retry, delay, err := sdi.fetch(ctx, client, id, t)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return failed(ErrCancelled)
+		}
+		if !retry {
+			return failed(err)
+		}
+
+		// the attempts are counted from the last request that got anywhere
+		if t.written != written {
+			attempt = 0
+		}
+		if attempt+1 >= policy.MaxRetries {
+			return failed(fmt.Errorf("gave up after %d attempts - %w", policy.MaxRetries, err))
+		}
+		delay = max(delay, policy.backoff(attempt))
+		sdi.Events.publish(RetryScheduled{
+			EventMeta: meta(0, id),
+			URL:       sdi.URL.String(),
+			Attempt:   attempt + 1,
+			Delay:     delay,
+			Err:       err,
+		})
+		attempt++
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return failed(ErrCancelled)
+		}
+	}
+
+	if sdi.Checksum != nil {
+		sdi.Events.publish(VerifyStarted{EventMeta: meta(-1, -1), Algorithm: sdi.Checksum.AlgoName})
+		if sum := hex.EncodeToString(t.hash.Sum(nil)); sum != sdi.Checksum.ExpectedHash {
+			return t.written, fmt.Errorf("checksum mismatch: expected %s | got %s", sdi.Checksum.ExpectedHash, sum)
+		}
+	}
+	return t.written, t.close()
+}
+
+// fetch makes request id for the bytes from t.written on and copies them to t. A failed request says
+// whether another one is worth it and how long the server asked us to wait
+func (sdi *StreamDownloadInfo) fetch(ctx context.Context, client *http.Client, id int64, t *streamTarget) (bool, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", sdi.URL.String(), nil)
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	setHeaders(req, sdi.Header)
+
+	// a broken stream continues where it stopped if the server can, otherwise it sends the whole file again
+	ifRange := ""
+	if t.written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", t.written))
+		ifRange = ifRangeValue(sdi.Validators)
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(connInfo httptrace.GotConnInfo) {
+			sdi.Events.publish(Connected{
+				EventMeta: meta(0, id),
+				Addr:      connInfo.Conn.RemoteAddr().String(),
+				Reused:    connInfo.Reused,
+				IdleTime:  connInfo.IdleTime,
+			})
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && t.written > 0:
+		if changeErr := detectChange(sdi.URL.String(), sdi.Validators, resp, ifRange != ""); changeErr != nil {
+			return false, 0, changeErr
+		}
+		if start, _, _, err := parseContentRange(resp.Header.Get("Content-Range")); err != nil || start != t.written {
+			return true, 0, fmt.Errorf("%w: asked for the bytes from %d, got Content-Range %q", ErrInvalidResponse, t.written, resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		if t.written > 0 {
+			if t.file == nil {
+				return false, 0, fmt.Errorf("the server can not resume the stream and %d bytes were already written", t.written)
+			}
+			if err := t.restart(); err != nil {
+				return false, 0, fmt.Errorf("could not start the file over - %w", err)
+			}
+			sdi.bytesWritten.Store(0)
+		}
+		if err := sdi.open(t, resp); err != nil {
+			return false, 0, err
+		}
+		// a resumed request has to continue this response, not the one the probe saw
+		sdi.Validators = validatorsFromResponse(resp)
+		sdi.totalSize.Store(resp.ContentLength)
+	case permanentStatus[resp.StatusCode]:
+		return false, 0, fmt.Errorf("%w: %s from %s", ErrPermanent, resp.Status, sdi.URL.String())
+	case throttleStatus[resp.StatusCode]:
+		return true, min(retryAfter(resp), sdi.RetryPolicy.MaxDelay), fmt.Errorf("bad status: %s", resp.Status)
+	default:
+		return true, 0, fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	body := newStallReader(resp.Body, sdi.Timeouts.Stall)
+	defer body.stop()
+	n, copyErr := streamCopy(body, t, func(n int64) {
+		total := sdi.bytesWritten.Add(n)
+		sdi.Events.publish(Progress{EventMeta: meta(0, id), Bytes: n, Total: total})
+	})
+	t.written += n
+
+	switch {
+	case t.err != nil:
+		// the destination is gone, asking the server again will not bring it back
+		return false, 0, t.err
+	case copyErr != nil:
+		if stallErr := body.err(); stallErr != nil {
+			copyErr = stallErr
+		}
+		return true, 0, fmt.Errorf("read failed after %d bytes, resuming at byte %d: %w", n, t.written, copyErr)
+	}
+	return false, 0, nil
+}
+
+// cleanupPartial closes the file of a stream that did not finish and removes it if DiscardPartial is set,
+// the returned error says which. A stream has no control file, a kept file can only be started over
+func (sdi *StreamDownloadInfo) cleanupPartial(t *streamTarget, reason error) error {
+	if t.file == nil {
+		// nothing was written to disk
+		return reason
+	}
+	t.close()
+	if sdi.DiscardPartial {
+		if err := os.Remove(t.filename); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%w\ncould not remove the partial file - %v", reason, err)
+		}
+		return fmt.Errorf("%w\npartial file removed", reason)
+	}
+	return fmt.Errorf("%w\n%d bytes kept in %s, a stream can not be resumed", reason, t.written, t.filename)
+}
+
+// open creates the output file for the first response, later ones write to the same destination
+func (sdi *StreamDownloadInfo) open(t *streamTarget, resp *http.Response) error {
+	if t.started {
+		return nil
+	}
+	if t.filename == "" {
+		t.filename = GetFileName(&sdi.URL, resp)
+	}
+	if t.dst == nil {
+		file, err := os.Create(t.filename)
+		if err != nil {
+			return err
+		}
+		t.file, t.dst = file, file
+	}
+	t.started = true
+	sdi.Events.publish(Started{EventMeta: meta(-1, -1), URL: sdi.URL.String(), Filename: t.filename, TotalSize: resp.ContentLength})
+	return nil
+}
+
+// streamTarget is where the bytes of a stream go across the requests that resume it, everything written
+// to it is hashed as well
+type streamTarget struct {
+	filename string
+	file     *os.File  // nil when writing to StreamDownloadInfo.Writer
+	dst      io.Writer // the file, created by the first response, or StreamDownloadInfo.Writer
+	hash     hash.Hash // nil without a checksum
+	written  int64
+	err      error // the first write error, streamCopy does not tell it apart from a broken body
+	started  bool
+	closed   bool
+}
+
+func (t *streamTarget) Write(p []byte) (int, error) {
+	n, err := t.dst.Write(p)
+	if t.hash != nil {
+		t.hash.Write(p[:n])
+	}
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
+
+// restart empties the file for a server that sends the whole file again
+func (t *streamTarget) restart() error {
+	if err := t.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if t.hash != nil {
+		t.hash.Reset()
+	}
+	t.written = 0
+	return nil
+}
+
+func (t *streamTarget) close() error {
+	if t.file == nil || t.closed {
+		return nil
+	}
+	t.closed = true
+	return t.file.Close()
+}
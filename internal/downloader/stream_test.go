@@ -0,0 +1,149 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a stream broken halfway asks for the rest of the same file, or starts over if the server can not resume
+func TestStreamDownloadResume(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(5)).Read(data)
+	const etag = `"v1"`
+	// the first request asks for everything, the second for the rest of the same version
+	wantHeaders := []string{" ", fmt.Sprintf("bytes=%d- %s", len(data)/2, etag)}
+	tests := []struct {
+		name   string
+		ranges bool // the server answers Range requests
+	}{
+		{name: "resumed with a range", ranges: true},
+		{name: "started over", ranges: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var headers []string // Range and If-Range of every request
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				headers = append(headers, r.Header.Get("Range")+" "+r.Header.Get("If-Range"))
+				first := len(headers) == 1
+				mu.Unlock()
+
+				w.Header().Set("ETag", etag)
+				if first {
+					cutBody(w, data, len(data)/2)
+					return
+				}
+				if tt.ranges {
+					http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+					return
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.Write(data)
+			}))
+			defer srv.Close()
+
+			filename := filepath.Join(t.TempDir(), "file.bin")
+			sdi := newTestStream(t, filename, srv.URL)
+			if err := sdi.StreamDownload(context.Background()); err != nil {
+				t.Fatalf("stream failed - %v", err)
+			}
+
+			got, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("downloaded file differs from the served one")
+			}
+			if !slices.Equal(headers, wantHeaders) {
+				t.Errorf("requests sent Range and If-Range %q, want %q", headers, wantHeaders)
+			}
+		})
+	}
+}
+
+// a stream that gives up keeps what it got or removes it with DiscardPartial, and says which
+func TestStreamDownloadFailedPartial(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(6)).Read(data)
+	tests := []struct {
+		name     string
+		discard  bool
+		wantText string
+		wantSize int64 // -1 when the file has to be gone
+	}{
+		{name: "kept", wantText: fmt.Sprintf("%d bytes kept in", len(data)/2), wantSize: int64(len(data) / 2)},
+		{name: "discarded", discard: true, wantText: "partial file removed", wantSize: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the first request breaks halfway, the file is gone when the stream asks for the rest
+			var requests atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) > 1 {
+					http.NotFound(w, r)
+					return
+				}
+				cutBody(w, data, len(data)/2)
+			}))
+			defer srv.Close()
+
+			filename := filepath.Join(t.TempDir(), "file.bin")
+			sdi := newTestStream(t, filename, srv.URL)
+			sdi.DiscardPartial = tt.discard
+			err := sdi.StreamDownload(context.Background())
+
+			if !errors.Is(err, ErrPermanent) {
+				t.Fatalf("stream returned %v, want the permanent error of the server", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantText) {
+				t.Errorf("error %q does not say %q", err, tt.wantText)
+			}
+			stat, statErr := os.Stat(filename)
+			switch {
+			case tt.wantSize < 0 && !os.IsNotExist(statErr):
+				t.Errorf("partial file was not removed - %v", statErr)
+			case tt.wantSize >= 0 && statErr != nil:
+				t.Errorf("partial file was not kept - %v", statErr)
+			case tt.wantSize >= 0 && stat.Size() != tt.wantSize:
+				t.Errorf("kept %d bytes, want %d", stat.Size(), tt.wantSize)
+			}
+		})
+	}
+}
+
+// <== Helper Functions ==>
+
+func newTestStream(t *testing.T, filename string, url string) *StreamDownloadInfo {
+	t.Helper()
+	sdi, err := InitStreamDownloadInfo(filename, url, Validators{}, StatusFlags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdi.RetryPolicy = RetryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	return sdi
+}
+
+// cutBody announces all of data and sends only the first n bytes, the connection is closed on return
+func cutBody(w http.ResponseWriter, data []byte, n int) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data[:n])
+	w.(http.Flusher).Flush()
+}
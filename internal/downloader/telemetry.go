@@ -1,28 +1,60 @@
 package downloader
 
 import (
-	"context"
+	"downpour/internal/utils"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
-func (rdi *RangeDownloadInfo) StartTelemetry(ctx context.Context) error {
-	f, err := os.Create(filepath.Join(rdi.DirName, "telemetry.csv"))
-	if err != nil {
-		return fmt.Errorf("[WARNING] Could not create the telemetry CSV file")
+// telemetryRecorder samples the download into telemetry.csv once a second, from the Started event
+// until the Completed or Failed one
+type telemetryRecorder struct {
+	dirName  string
+	snapshot func() DownloadSnapshot
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newTelemetryRecorder(dirName string, snapshot func() DownloadSnapshot) *telemetryRecorder {
+	return &telemetryRecorder{dirName: dirName, snapshot: snapshot}
+}
+
+func (r *telemetryRecorder) HandleEvent(e Event) {
+	switch e.(type) {
+	case Started:
+		if r.stop != nil {
+			return
+		}
+		f, err := os.Create(filepath.Join(r.dirName, "telemetry.csv"))
+		if err != nil {
+			// the download goes on without telemetry
+			return
+		}
+		r.stop = make(chan struct{})
+		r.done = make(chan struct{})
+		go r.record(f)
+	case Completed, Failed:
+		if r.stop != nil {
+			close(r.stop)
+			<-r.done
+			r.stop = nil
+		}
 	}
+}
+
+func (r *telemetryRecorder) record(f *os.File) {
+	defer close(r.done)
 	defer f.Close()
 
 	// Build worker's speed headers
 	var workersSpeedHeader strings.Builder
-	for _, workerInfo := range rdi.Workers.Slice {
+	for _, workerInfo := range r.snapshot().Workers {
 		fmt.Fprintf(&workersSpeedHeader, "W%d(B/s),", workerInfo.ID)
 	}
-	fmt.Fprintf(f, "Timestamp(s),TotalBytes,Speed(B/s),%s\n", workersSpeedHeader.String())
+	fmt.Fprintf(f, "Timestamp(s),TotalBytes,Speed(B/s),ActiveWorkers,%s\n", workersSpeedHeader.String())
 
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
@@ -30,34 +62,98 @@ func (rdi *RangeDownloadInfo) StartTelemetry(ctx context.Context) error {
 	var lastDownloaded int64
 	startTime := time.Now()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case t := <-ticker.C:
-			// download data
-			currentTotal := rdi.BytesWritten.Load()
+	sample := func(t time.Time) {
+		// download data
+		snapshot := r.snapshot()
+		currentTotal := snapshot.BytesWritten
+
+		delta := currentTotal - lastDownloaded
 
-			delta := currentTotal - lastDownloaded
+		lastDownloaded = currentTotal
 
-			lastDownloaded = currentTotal
+		elapsed := t.Sub(startTime).Seconds()
 
-			elapsed := t.Sub(startTime).Seconds()
+		// worker details, parked and finished workers are reported as 0 so a replay knows they stopped
+		var workersSpeed strings.Builder
+		for _, workerInfo := range snapshot.Workers {
+			speed := workerInfo.Speed
+			if workerInfo.Status == WorkerStatusParked || workerInfo.Status == WorkerStatusDone {
+				speed = 0
+			}
+			fmt.Fprintf(&workersSpeed, "%.0f,", speed)
+		}
+		fmt.Fprintf(f, "%.0f,%d,%.0f,%d,%s\n", elapsed, currentTotal, float64(delta), snapshot.ActiveWorkers, workersSpeed.String())
+	}
 
-			// worker details
-			var workersSpeed strings.Builder
-			for _, workerInfo := range rdi.Workers.Slice {
-				fmt.Fprintf(&workersSpeed, "%.0f,", workerInfo.Speed)
+	for {
+		select {
+		case <-r.stop:
+			// one last row so the file ends with the final byte count
+			if r.snapshot().BytesWritten != lastDownloaded {
+				sample(time.Now())
 			}
-			fmt.Fprintf(f, "%.0f,%d,%.0f,%s\n", elapsed, currentTotal, float64(delta), workersSpeed.String())
+			return
+		case t := <-ticker.C:
+			sample(t)
 		}
 	}
 }
 
-func (rdi *RangeDownloadInfo) getTraceLogger() (*log.Logger, *os.File) {
-	f, err := os.OpenFile(filepath.Join(rdi.DirName, "httptrace.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// traceLog writes what the workers (or the connection of a stream) do to httptrace.log
+type traceLog struct {
+	file *os.File
+}
+
+func newTraceLog(path string) (*traceLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("could not open the trace log - %w", err)
+	}
+	return &traceLog{file: f}, nil
+}
+
+func (l *traceLog) close() {
+	l.file.Close()
+}
+
+func (l *traceLog) HandleEvent(e Event) {
+	var msg string
+	switch e := e.(type) {
+	case Connected:
+		if e.Reused {
+			msg = fmt.Sprintf("Connection Reused | IdleTime: %v", e.IdleTime)
+		} else {
+			msg = fmt.Sprintf("NEW Connection Dialed | Addr: %v", e.Addr)
+		}
+	case ChunkStarted:
+		if e.StolenFrom >= 0 {
+			msg = fmt.Sprintf("STOLE bytes %d-%d from Worker %d", e.Start, e.End, e.StolenFrom)
+		} else if e.RacingWith >= 0 {
+			msg = fmt.Sprintf("RACING Worker %d for bytes %d-%d", e.RacingWith, e.Start, e.End)
+		}
+	case RaceLost:
+		msg = "LOST the race, dropping the request"
+	case RetryScheduled:
+		msg = fmt.Sprintf("Mirror %s failed (attempt %d), retrying in %v: %v", e.URL, e.Attempt, e.Delay.Round(time.Millisecond), e.Err)
+	case MirrorDisabled:
+		msg = fmt.Sprintf("Mirror %s disabled: %v", e.URL, e.Err)
+	case ChunkFailed:
+		if e.Requeued {
+			msg = fmt.Sprintf("FAILED, range re-queued | %v", e.Err)
+		} else {
+			msg = fmt.Sprintf("ABORTING | %v", e.Err)
+		}
+	case WorkerRestarted:
+		msg = fmt.Sprintf("RESTARTED | Worker Speed was: %s | Workers Baseline Speed: %s | Resuming at byte %d of chunk",
+			utils.FormatSpeedString(e.Speed, "B/s"),
+			utils.FormatSpeedString(e.Baseline, "B/s"),
+			e.Offset)
 	}
-	return log.New(f, "", log.LstdFlags|log.Lmicroseconds), f
+	if msg == "" {
+		return
+	}
+
+	// stamped with the time of the event, the log can lag behind a little
+	m := e.Meta()
+	fmt.Fprintf(l.file, "%s [Worker %2d::Chunk %4d] %s\n", m.Time.Format("2006/01/02 15:04:05.000000"), m.WorkerID, m.ChunkID, msg)
 }
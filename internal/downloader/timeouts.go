@@ -0,0 +1,69 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// returned (wrapped) when a response stopped sending bytes for longer than Timeouts.Stall
+var ErrStalled = errors.New("connection stalled")
+
+// Timeouts for every request a worker makes, zero disables a timeout
+type Timeouts struct {
+	Connect      time.Duration // TCP connect
+	TLSHandshake time.Duration
+	FirstByte    time.Duration // from sending the request to the response headers
+	Stall        time.Duration // longest gap between two reads of the body
+}
+
+var DefaultTimeouts = Timeouts{
+	Connect:      10 * time.Second,
+	TLSHandshake: 10 * time.Second,
+	FirstByte:    15 * time.Second,
+	Stall:        10 * time.Second,
+}
+
+// stallReader closes the response body once no bytes arrived for the given duration (0 never does),
+// the blocked Read then fails and err says why
+type stallReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+func newStallReader(body io.ReadCloser, timeout time.Duration) *stallReader {
+	s := &stallReader{body: body, timeout: timeout}
+	if timeout > 0 {
+		s.timer = time.AfterFunc(timeout, func() {
+			s.stalled.Store(true)
+			body.Close()
+		})
+	}
+	return s
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	if n > 0 && s.timer != nil {
+		s.timer.Reset(s.timeout)
+	}
+	return n, err
+}
+
+func (s *stallReader) stop() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// err returns the reason the body was closed by the watchdog, nil if it was not
+func (s *stallReader) err() error {
+	if !s.stalled.Load() {
+		return nil
+	}
+	return fmt.Errorf("%w: no bytes for %v", ErrStalled, s.timeout)
+}
@@ -0,0 +1,109 @@
+package downloader
+
+import (
+	"net/http"
+	"sync"
+)
+
+const defaultThreshold = 16 * 1024 * 1024 // 16MB
+
+// Transport speeds up large downloads made through an http.Client. A GET whose response is at least
+// Threshold and advertises byte ranges gets a body that is fetched by parallel range requests through
+// Base and read back in order, everything else passes through untouched
+type Transport struct {
+	Base        http.RoundTripper // http.DefaultTransport when nil
+	Threshold   int64             // smallest response that is split, 16MB when 0
+	Workers     int
+	ChunkSize   int64
+	BufferSize  int64
+	RetryPolicy RetryPolicy
+	Subscribers []Subscriber // subscribed to the events of every split response, called one event at a time
+	deliverMu   sync.Mutex   // held while a subscriber handles an event of any response
+}
+
+func NewTransport(base http.RoundTripper) *Transport {
+	return &Transport{
+		Base:        base,
+		Workers:     defaultRemoteWorkers,
+		ChunkSize:   defaultStreamChunkSize,
+		RetryPolicy: DefaultRetryPolicy,
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base()
+	resp, err := base.RoundTrip(req)
+	if err != nil || !t.Splittable(req, resp) {
+		return resp, err
+	}
+
+	// the first response already holds a connection for the whole body, it is given up for the ranges
+	resp.Body.Close()
+
+	pr := NewParallelReader(resp.Request.URL.String(), resp.ContentLength, validatorsFromResponse(resp))
+	pr.Transport = base
+	pr.Header = req.Header.Clone()
+	pr.RetryPolicy = t.RetryPolicy
+	pr.Workers = t.Workers
+	pr.ChunkSize = t.ChunkSize
+	pr.BufferSize = t.BufferSize
+	// every response has a bus of its own, the subscribers still only see one event at a time
+	for _, s := range t.Subscribers {
+		pr.Events.Subscribe(&lockedSubscriber{mu: &t.deliverMu, s: s})
+	}
+	pr.Start(req.Context())
+
+	resp.Body = &transportBody{pr: pr}
+	return resp, nil
+}
+
+// Splittable tells whether the response to req is worth fetching again with parallel ranges, only a
+// plain GET of a whole, uncompressed file can be
+func (t *Transport) Splittable(req *http.Request, resp *http.Response) bool {
+	threshold := t.Threshold
+	if threshold <= 0 {
+		threshold = defaultThreshold
+	}
+	return req.Method == http.MethodGet &&
+		req.Header.Get("Range") == "" &&
+		resp.StatusCode == http.StatusOK &&
+		resp.ContentLength >= threshold &&
+		resp.Header.Get("Accept-Ranges") == "bytes" &&
+		resp.Header.Get("Content-Encoding") == "" &&
+		!resp.Uncompressed
+}
+
+// <== Helper Functions ==>
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+// lockedSubscriber hands events to s while holding mu, which is shared by the buses of all responses
+type lockedSubscriber struct {
+	mu *sync.Mutex
+	s  Subscriber
+}
+
+func (l *lockedSubscriber) HandleEvent(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.s.HandleEvent(e)
+}
+
+// transportBody stops the workers and flushes the subscribers when the response body is closed
+type transportBody struct {
+	pr *ParallelReader
+}
+
+func (b *transportBody) Read(p []byte) (int, error) {
+	return b.pr.Read(p)
+}
+
+func (b *transportBody) Close() error {
+	b.pr.Close()
+	b.pr.Events.Close()
+	return nil
+}
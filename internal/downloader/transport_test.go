@@ -0,0 +1,143 @@
+package downloader
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransportSplit(t *testing.T) {
+	data := make([]byte, 8*minChunkSize)
+	rand.New(rand.NewSource(3)).Read(data)
+	tests := []struct {
+		name         string
+		method       string
+		rangeHeader  string
+		threshold    int64
+		noRanges     bool // the server does not advertise byte ranges
+		wantRequests int64
+	}{
+		{name: "large GET is split", method: http.MethodGet, threshold: minChunkSize, wantRequests: 1 + 8},
+		{name: "below the threshold", method: http.MethodGet, threshold: int64(len(data)) + 1, wantRequests: 1},
+		{name: "no byte ranges", method: http.MethodGet, threshold: minChunkSize, noRanges: true, wantRequests: 1},
+		{name: "not a GET", method: http.MethodPost, threshold: minChunkSize, wantRequests: 1},
+		{name: "already a range", method: http.MethodGet, rangeHeader: "bytes=0-", threshold: minChunkSize, wantRequests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				if tt.noRanges {
+					w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+					w.Write(data)
+					return
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			}))
+			defer srv.Close()
+
+			transport := NewTransport(nil)
+			transport.Threshold = tt.threshold
+			transport.Workers = 4
+			transport.ChunkSize = minChunkSize
+			client := &http.Client{Transport: transport}
+
+			req, err := http.NewRequest(tt.method, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			got := readBody(t, client, req)
+
+			if !bytes.Equal(got, data) {
+				t.Error("response body differs from the served one")
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("server got %d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+// the events of concurrent responses reach a subscriber one at a time
+func TestTransportSerializesSubscribers(t *testing.T) {
+	data := make([]byte, 8*minChunkSize)
+	rand.New(rand.NewSource(4)).Read(data)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	var inFlight atomic.Int32
+	var overlapped atomic.Bool
+	completed := 0 // only touched by the subscriber, which is never called concurrently
+	transport := NewTransport(nil)
+	transport.Threshold = minChunkSize
+	transport.Workers = 4
+	transport.ChunkSize = minChunkSize
+	transport.Subscribers = []Subscriber{SubscriberFunc(func(e Event) {
+		if inFlight.Add(1) > 1 {
+			overlapped.Store(true)
+		}
+		time.Sleep(100 * time.Microsecond)
+		if _, ok := e.(Completed); ok {
+			completed++
+		}
+		inFlight.Add(-1)
+	})}
+	client := &http.Client{Transport: transport}
+
+	const responses = 4
+	var wg sync.WaitGroup
+	for range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := readBody(t, client, req); !bytes.Equal(got, data) {
+				t.Error("response body differs from the served one")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if overlapped.Load() {
+		t.Error("subscriber handled events of two responses at once")
+	}
+	if completed != responses {
+		t.Errorf("subscriber saw %d completed responses, want %d", completed, responses)
+	}
+}
+
+// <== Helper Functions ==>
+
+// readBody reads the whole response, closing the body flushes the events of a split response
+func readBody(t *testing.T, client *http.Client, req *http.Request) []byte {
+	t.Helper()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Errorf("request failed - %v", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("reading the body failed - %v", err)
+	}
+	return body
+}
@@ -0,0 +1,95 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// returned (wrapped) when a ranged response does not match what was asked for, always retryable
+var ErrInvalidResponse = errors.New("invalid ranged response")
+
+// parseContentRange parses a "bytes start-end/total" header, total is -1 when the server sent "*"
+func parseContentRange(header string) (start int64, end int64, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("unsupported Content-Range %q", header)
+	}
+
+	rangePart, totalPart, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+	}
+
+	total = -1
+	if totalPart != "*" {
+		if total, err = parseOffset(totalPart); err != nil {
+			return 0, 0, 0, fmt.Errorf("malformed Content-Range total %q", header)
+		}
+	}
+
+	startPart, endPart, ok := strings.Cut(rangePart, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range range %q", header)
+	}
+	if start, err = parseOffset(startPart); err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range range %q", header)
+	}
+	if end, err = parseOffset(endPart); err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range range %q", header)
+	}
+	if end < start || (total >= 0 && end >= total) {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	return start, end, total, nil
+}
+
+// validateRangeResponse checks that a 206 response is exactly the range that was requested
+func validateRangeResponse(resp *http.Response, startPos int64, endPos int64, totalSize int64) error {
+	header := resp.Header.Get("Content-Range")
+	if header == "" {
+		return fmt.Errorf("%w: missing Content-Range for bytes %d-%d", ErrInvalidResponse, startPos, endPos)
+	}
+
+	start, end, total, err := parseContentRange(header)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	if start != startPos || end != endPos {
+		return fmt.Errorf("%w: asked for bytes %d-%d, got %d-%d", ErrInvalidResponse, startPos, endPos, start, end)
+	}
+	if total != totalSize {
+		return fmt.Errorf("%w: expected total size %d, Content-Range reports %d", ErrInvalidResponse, totalSize, total)
+	}
+
+	expected := endPos - startPos + 1
+	if resp.ContentLength >= 0 && resp.ContentLength != expected {
+		return fmt.Errorf("%w: expected %d bytes, Content-Length is %d", ErrInvalidResponse, expected, resp.ContentLength)
+	}
+	return nil
+}
+
+// checkBodyLength runs after exactly the expected number of bytes were read (or the body ended early)
+// and makes sure the body was neither truncated nor longer than the requested range
+func checkBodyLength(body io.Reader, n int64, expected int64) error {
+	if n < expected {
+		return fmt.Errorf("%w: short body, expected %d bytes, got %d", ErrInvalidResponse, expected, n)
+	}
+
+	var extra [1]byte
+	if m, _ := body.Read(extra[:]); m > 0 {
+		return fmt.Errorf("%w: body is longer than the requested %d bytes", ErrInvalidResponse, expected)
+	}
+	return nil
+}
+
+// parseOffset parses a byte offset of a Content-Range, only plain digits are accepted
+func parseOffset(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, fmt.Errorf("not a byte offset %q", s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
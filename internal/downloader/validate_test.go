@@ -0,0 +1,56 @@
+package downloader
+
+import "testing"
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header    string
+		wantStart int64
+		wantEnd   int64
+		wantTotal int64
+		wantErr   bool
+	}{
+		{"bytes 0-99/100", 0, 99, 100, false},
+		{"bytes 100-199/1000", 100, 199, 1000, false},
+		{"bytes 5-5/6", 5, 5, 6, false},
+		{"bytes 0-99/*", 0, 99, -1, false},
+		{"", 0, 0, 0, true},
+		{"items 0-99/100", 0, 0, 0, true},
+		{"bytes 0-99", 0, 0, 0, true},
+		{"bytes */100", 0, 0, 0, true},
+		{"bytes 0-99/abc", 0, 0, 0, true},
+		{"bytes a-b/100", 0, 0, 0, true},
+		{"bytes 99-0/100", 0, 0, 0, true},
+		{"bytes -5-10/100", 0, 0, 0, true},
+		{"bytes 0-99/100abc", 0, 0, 0, true},
+		{"bytes 0-99abc/100", 0, 0, 0, true},
+		{"bytes 0abc-99/100", 0, 0, 0, true},
+		{"bytes 0-99/100 ", 0, 0, 0, true},
+		{"bytes  0-99/100", 0, 0, 0, true},
+		{"bytes +0-99/100", 0, 0, 0, true},
+		{"bytes 0-+99/100", 0, 0, 0, true},
+		{"bytes 0--99/100", 0, 0, 0, true},
+		{"bytes 0-99/-1", 0, 0, 0, true},
+		{"bytes 0-99/*x", 0, 0, 0, true},
+		{"bytes 0-/100", 0, 0, 0, true},
+		{"bytes 0-100/100", 0, 0, 0, true},
+		{"bytes 0-99/99999999999999999999", 0, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		start, end, total, err := parseContentRange(tt.header)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseContentRange(%q) = %d, %d, %d, want an error", tt.header, start, end, total)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseContentRange(%q) failed - %v", tt.header, err)
+			continue
+		}
+		if start != tt.wantStart || end != tt.wantEnd || total != tt.wantTotal {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, want %d, %d, %d", tt.header, start, end, total, tt.wantStart, tt.wantEnd, tt.wantTotal)
+		}
+	}
+}
@@ -1,18 +1,27 @@
 package downloader
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math"
+	"net"
 	"net/http"
-	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// returned by downloadChunk when the health monitor aborted the in-flight request
+var errWorkerRestarted = errors.New("worker restarted by health monitor")
+
+// returned by downloadChunk when another worker finished the same bytes first during the endgame
+var errRaceLost = errors.New("range finished first by another worker")
+
 type ChunkInfo struct {
-	Index           int64
+	Index           int64 // sequence number of the task the worker is on
+	Start           int64
 	Size            int64
 	BytesDownloaded int64
 }
@@ -26,127 +35,232 @@ const (
 	WorkerStatusRetrying    WorkerStatus = "retrying"
 	WorkerStatusDone        WorkerStatus = "done"
 	WorkerStatusRestarting  WorkerStatus = "restarting"
+	WorkerStatusParked      WorkerStatus = "parked"
 )
 
 type WorkerInfo struct {
 	ID                int
+	RestartWorkerChan chan struct{}
+	HttpClient        *http.Client // only used by the worker itself
+
+	bytesWritten atomic.Int64 // everything written to the file, committed or not
+
+	mu          sync.Mutex // guards the fields below, read them through Snapshot
+	chunk       ChunkInfo
+	speed       float64 // smoothed, bytes per second
+	status      WorkerStatus
+	startedAt   time.Time
+	restartedAt time.Time
+	lastBytes   int64
+	lastSample  time.Time
+	cancelChunk context.CancelCauseFunc
+
+	running bool        // guarded by RangeDownloadInfo.poolMu
+	retire  atomic.Bool // set by the concurrency controller, the worker exits before its next chunk
+}
+
+// WorkerSnapshot is a copy of a worker's statistics, safe to keep and read from any goroutine
+type WorkerSnapshot struct {
+	ID                int
+	Status            WorkerStatus
+	Speed             float64 // smoothed, bytes per second
 	Chunk             ChunkInfo
-	Speed             float64
 	TotalBytesWritten int64
-	LastBytes         int64
-	LastSample        time.Time
-	Status            WorkerStatus
 	StartedAt         time.Time
 	RestartedAt       time.Time
-	RestartWorkerChan chan struct{}
-	HttpClient        *http.Client
 }
 
-func (info *WorkerInfo) UpdateSpeed() float64 {
-	if info.LastSample.IsZero() {
-		info.LastBytes = info.TotalBytesWritten
-		info.LastSample = time.Now()
+// inFlight tells whether a worker in this status has a request going, a restarting one is about to
+// reconnect and is judged again once it has
+func (s WorkerStatus) inFlight() bool {
+	switch s {
+	case WorkerStatusRequesting, WorkerStatusDownloading, WorkerStatusRetrying:
+		return true
+	}
+	return false
+}
+
+func newWorkerInfo(id int) *WorkerInfo {
+	return &WorkerInfo{
+		ID:                id,
+		status:            WorkerStatusParked,
+		RestartWorkerChan: make(chan struct{}, 1),
+	}
+}
+
+// Snapshot returns a consistent copy of the worker's statistics
+func (info *WorkerInfo) Snapshot() WorkerSnapshot {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	return WorkerSnapshot{
+		ID:                info.ID,
+		Status:            info.status,
+		Speed:             info.speed,
+		Chunk:             info.chunk,
+		TotalBytesWritten: info.bytesWritten.Load(),
+		StartedAt:         info.startedAt,
+		RestartedAt:       info.restartedAt,
+	}
+}
+
+// restart signals the worker to reconnect and aborts the request it currently has in flight
+func (info *WorkerInfo) restart() {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	info.status = WorkerStatusRestarting
+	info.restartedAt = time.Now()
+	signalRestart(info.RestartWorkerChan)
+	if info.cancelChunk != nil {
+		info.cancelChunk(errWorkerRestarted)
+	}
+}
+
+func (info *WorkerInfo) setChunkCancel(cancel context.CancelCauseFunc) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.cancelChunk = cancel
+}
+
+func (info *WorkerInfo) setStatus(status WorkerStatus) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.status = status
+}
+
+// started resets the clocks the health monitor and the scheduler judge a fresh worker by
+func (info *WorkerInfo) started() {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.startedAt = time.Now()
+	info.restartedAt = info.startedAt
+}
+
+func (info *WorkerInfo) startChunk(index int64, start int64, size int64) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.status = WorkerStatusIdle
+	info.chunk = ChunkInfo{
+		Index: index,
+		Start: start,
+		Size:  size,
+	}
+}
+
+func (info *WorkerInfo) addChunkBytes(n int64) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.chunk.BytesDownloaded += n
+}
+
+// updateSpeed folds the bytes written since the last call into the smoothed speed
+func (info *WorkerInfo) updateSpeed() float64 {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	written := info.bytesWritten.Load()
+	if info.lastSample.IsZero() {
+		info.lastBytes = written
+		info.lastSample = time.Now()
 		return 0
 	}
-	deltaBytes := info.TotalBytesWritten - info.LastBytes
-	info.LastBytes = info.TotalBytesWritten
-	deltaTime := time.Since(info.LastSample).Seconds()
-	info.LastSample = time.Now()
+	deltaBytes := written - info.lastBytes
+	info.lastBytes = written
+	deltaTime := time.Since(info.lastSample).Seconds()
+	info.lastSample = time.Now()
 	curSpeed := float64(deltaBytes) / deltaTime
-	info.Speed = (0.7 * info.Speed) + (0.3 * curSpeed)
+	info.speed = (0.7 * info.speed) + (0.3 * curSpeed)
 	return curSpeed
 }
 
-func (workerInfo *WorkerInfo) downloadChunk(chunkIndex int, rdi *RangeDownloadInfo, logger *log.Logger) error {
-	workerInfo.Status = WorkerStatusIdle
-	startPos := ((int64(chunkIndex)) * rdi.ChunkSize)
-	endPos := int64(math.Min(float64(((int64(chunkIndex)+1)*rdi.ChunkSize)-1), float64(rdi.TotalSize-1)))
-
-	// Add information to the WorkerInfo
-	workerInfo.Chunk.Index = int64(chunkIndex)
-	workerInfo.Chunk.Size = endPos - startPos
-	workerInfo.Chunk.BytesDownloaded = 0
-
-	const maxRetries = 5
-	var resp *http.Response
-	var doErr error
-	var success bool
-
-	for range maxRetries {
-		workerInfo.Status = WorkerStatusRequesting
-		req, err := http.NewRequest("GET", rdi.ReqURL, nil)
-		if err != nil {
-			return err
-		}
-		req.Header.Add("Range", fmt.Sprintf("bytes=%v-%v", startPos, endPos))
-
-		if rdi.StatusFlags.EnableTrace {
-			trace := &httptrace.ClientTrace{
-				GotConn: func(connInfo httptrace.GotConnInfo) {
-					if connInfo.Reused {
-						logger.Printf("[Worker %2d::Chunk %4d] Connection Reused | IdleTime: %v", workerInfo.ID, workerInfo.Chunk.Index, connInfo.IdleTime)
-					} else {
-						logger.Printf("[Worker %2d::Chunk %4d] NEW Connection Dialed | Addr: %v", workerInfo.ID, workerInfo.Chunk.Index, connInfo.Conn.RemoteAddr())
-					}
-				},
-				WroteRequest: func(info httptrace.WroteRequestInfo) {
-					if info.Err != nil {
-						logger.Printf("[Worker %d::Chunk %d] Write Error: %v", workerInfo.ID, workerInfo.Chunk.Index, info.Err)
-					}
-				},
-			}
+func (workerInfo *WorkerInfo) downloadChunk(t *task, rdi *RangeDownloadInfo) error {
+	workerInfo.startChunk(t.id, t.start, t.end-t.start)
 
-			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
-		}
+	// per-chunk context so the health monitor can abort a stalled request mid-body
+	ctx, cancel := context.WithCancelCause(rdi.ctx)
+	workerInfo.setChunkCancel(cancel)
+	t.setCancel(cancel)
+	defer func() {
+		workerInfo.setChunkCancel(nil)
+		t.setCancel(nil)
+		cancel(nil)
+	}()
 
-		resp, doErr = workerInfo.HttpClient.Do(req)
-		if doErr == nil && resp.StatusCode == http.StatusPartialContent {
-			success = true
-			break
-		}
+	target := &taskTarget{rdi: rdi, worker: workerInfo, task: t}
+	err := rdi.fetcher.do(ctx, workerInfo.HttpClient, rangeRequester{worker: workerInfo, chunk: t.id}, target)
+	if err != nil && ctx.Err() != nil {
+		return abortReason(ctx)
+	}
+	return err
+}
 
-		// close the response body if we received some other Reponse apart from StatusPartialContent
-		if resp != nil {
-			resp.Body.Close()
-		}
+// taskTarget writes the responses for a task straight into the file, bytes only count once committed
+type taskTarget struct {
+	rdi    *RangeDownloadInfo
+	worker *WorkerInfo
+	task   *task
+	cw     *chunkWriter // the writer of the last copy until it is committed or discarded
+}
 
-		workerInfo.Status = WorkerStatusRetrying
+func (tt *taskTarget) missing() (int64, int64) {
+	return tt.task.bounds()
+}
 
-		// TODO: implement exponential backoff
-		time.Sleep(time.Second * 1)
-	}
+func (tt *taskTarget) copy(body io.Reader, start int64, expected int64) (int64, error) {
+	cw := tt.rdi.WriterPool.Get().(*chunkWriter)
+	cw.worker = tt.worker
+	cw.task = tt.task
+	cw.state = tt.rdi.State
+	cw.events = tt.rdi.Events
+	cw.offset = start
+	cw.start = start
+	cw.committed = 0
+	tt.cw = cw
 
-	if !success {
-		return fmt.Errorf("FATAL: worker %d failed on chunk %d after %d retries. Last error: %v", workerInfo.ID, workerInfo.Chunk.Index, maxRetries, doErr)
+	n, err := io.CopyBuffer(cw, io.LimitReader(body, expected), cw.buf)
+	if err == nil && n < expected && start+n >= tt.task.limit() {
+		// the body ended early but the end of the task was cut meanwhile, nothing is missing
+		err = errRangeStolen
 	}
+	return n, err
+}
 
-	// write to file
-	workerInfo.Status = WorkerStatusDownloading
-	cw := rdi.WriterPool.Get().(*chunkWriter)
-	cw.worker = workerInfo
-	cw.offset = startPos
-	_, copyErr := io.CopyBuffer(cw, resp.Body, cw.buf)
-	if copyErr != nil {
-		resp.Body.Close()
-		rdi.WriterPool.Put(cw)
-		return copyErr
+func (tt *taskTarget) commit(n int64) {
+	tt.cw.commit(n)
+	tt.discard()
+}
+
+func (tt *taskTarget) discard() {
+	tt.rdi.WriterPool.Put(tt.cw)
+	tt.cw = nil
+}
+
+// abortReason tells a lost endgame race apart from a restart once the chunk context was cancelled
+func abortReason(ctx context.Context) error {
+	if errors.Is(context.Cause(ctx), errRaceLost) {
+		return errRaceLost
 	}
-	resp.Body.Close()
-	rdi.WriterPool.Put(cw)
-	workerInfo.Status = WorkerStatusIdle
-	return nil
+	return errWorkerRestarted
 }
 
-func newWorkerClient() *http.Client {
+func newWorkerClient(timeouts Timeouts) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Connect,
+		KeepAlive: 30 * time.Second,
+	}
 	tr := http.Transport{
-		MaxIdleConnsPerHost: workerLimit,
-		MaxConnsPerHost:     0,
-		DisableKeepAlives:   false,
-		IdleConnTimeout:     10 * time.Second,
-		ForceAttemptHTTP2:   false,
-		TLSNextProto:        make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
-		ReadBufferSize:      bufferSize,
-		WriteBufferSize:     bufferSize,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.FirstByte,
+		MaxIdleConnsPerHost:   workerLimit,
+		MaxConnsPerHost:       0,
+		DisableKeepAlives:     false,
+		IdleConnTimeout:       10 * time.Second,
+		ForceAttemptHTTP2:     false,
+		TLSNextProto:          make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
+		ReadBufferSize:        bufferSize,
+		WriteBufferSize:       bufferSize,
 	}
 	client := &http.Client{
 		Transport: &tr,
@@ -156,6 +270,9 @@ func newWorkerClient() *http.Client {
 			}
 			// A small safeguard to make sure the correct range headers are copied over through the redirections
 			req.Header.Set("Range", via[0].Header.Get("Range"))
+			if ifRange := via[0].Header.Get("If-Range"); ifRange != "" {
+				req.Header.Set("If-Range", ifRange)
+			}
 			return nil
 		},
 	}
@@ -7,41 +7,60 @@ import (
 	"sync/atomic"
 )
 
-// To be implemented after implementation of multi mirror downloading
-// type writeJob struct {
-// 	buf    *[]byte
-// 	offset int64
-// 	n      int64
-// }
-
-// func writerWorker(jobQueue chan writeJob, f *os.File, pool *sync.Pool, bytesWrittern *atomic.Int64, onError ErrorFunc) {
-
-// }
-
 // struct to implement io.Writer for custom use of WriteAt() instead of Write() in io.Copy()
-
 type chunkWriter struct {
 	buf                []byte
 	worker             *WorkerInfo
+	task               *task
 	file               *os.File
 	offset             int64
+	start              int64 // where the response began
+	committed          int64 // bytes of the response committed so far
 	globalBytesWritten *atomic.Int64
+	state              *ResumeState
+	events             *EventBus
 }
 
 func (cw *chunkWriter) Write(p []byte) (int, error) {
-	nwrite, err := cw.file.WriteAt(p, int64(cw.offset))
+	// never write past the end of the task, another worker may have stolen the rest of it
+	allowed := cw.task.reserve(cw.offset, int64(len(p)))
+	nwrite, err := cw.file.WriteAt(p[:allowed], int64(cw.offset))
 	if err != nil {
 		return nwrite, fmt.Errorf("Could not write to file at offset %v - %v", cw.offset, err)
 	}
 	cw.offset += int64(nwrite)
-	cw.worker.Chunk.BytesDownloaded += int64(nwrite)
-	cw.worker.TotalBytesWritten += int64(nwrite)
-	cw.globalBytesWritten.Add(int64(nwrite))
+	cw.worker.bytesWritten.Add(int64(nwrite))
+	// a long response counts as it goes instead of all at once at its end. The headers are valid by now
+	// and a broken body keeps what arrived anyway, only a body running past the range is not caught
+	// until then (the copy never reads past it, so the bytes in range are kept)
+	if written := cw.offset - cw.start; written-cw.committed >= commitInterval {
+		cw.commit(written)
+	}
+	if allowed < int64(len(p)) {
+		return nwrite, errRangeStolen
+	}
 	return nwrite, nil
 }
 
+// commit accounts the first n written bytes of the response to the task and the download, the ones
+// committed before are skipped
+func (cw *chunkWriter) commit(n int64) {
+	n -= cw.committed
+	if n <= 0 {
+		return
+	}
+	cw.committed += n
+	r := cw.task.commit(n)
+	cw.worker.addChunkBytes(n)
+	// bytes an endgame race already wrote are not counted twice
+	if added := cw.state.markDone(r); added > 0 {
+		total := cw.globalBytesWritten.Add(added)
+		cw.events.publish(Progress{EventMeta: meta(cw.worker.ID, cw.task.id), Bytes: added, Total: total})
+	}
+}
+
 // copy with progress callback
-func streamCopy(src io.Reader, dst io.Writer, onProgress ProgressFunc) (int64, error) {
+func streamCopy(src io.Reader, dst io.Writer, onProgress func(n int64)) (int64, error) {
 	var totalWritten, chunkWritten int64
 	buf := make([]byte, bufferSize)
 
@@ -0,0 +1,62 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChunkWriterCommitsInSteps(t *testing.T) {
+	const size = 5*commitInterval + 1000
+	tests := []struct {
+		name       string
+		write      int64 // bytes written before looking
+		wantDone   int64 // committed while the response is still going
+		finalTotal int64 // committed once the response is done
+	}{
+		{"less than a step", commitInterval - 1, 0, commitInterval - 1},
+		{"one step", commitInterval, commitInterval, commitInterval},
+		{"between steps", 2*commitInterval + 10, 2 * commitInterval, 2*commitInterval + 10},
+		{"whole response", size, 5 * commitInterval, size},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			s := newScheduler(rangeSet{{0, size}}, size)
+			wi := newWorkerInfo(0)
+			var global atomic.Int64
+			cw := &chunkWriter{
+				worker:             wi,
+				task:               takeAll(s, wi),
+				file:               file,
+				globalBytesWritten: &global,
+				state:              newResumeState(filepath.Join(t.TempDir(), "file"+controlFileExt)),
+			}
+
+			buf := make([]byte, bufferSize)
+			for written := int64(0); written < tt.write; {
+				n, err := cw.Write(buf[:min(int64(len(buf)), tt.write-written)])
+				if err != nil {
+					t.Fatal(err)
+				}
+				written += int64(n)
+			}
+			if cw.task.done != tt.wantDone || global.Load() != tt.wantDone {
+				t.Errorf("committed %d bytes (%d counted) while writing, want %d", cw.task.done, global.Load(), tt.wantDone)
+			}
+
+			// the end of the response commits the rest, nothing twice
+			cw.commit(tt.write)
+			if cw.task.done != tt.finalTotal || global.Load() != tt.finalTotal || cw.state.CompletedBytes() != tt.finalTotal {
+				t.Errorf("committed %d bytes (%d counted, %d on disk) at the end, want %d", cw.task.done, global.Load(), cw.state.CompletedBytes(), tt.finalTotal)
+			}
+		})
+	}
+}
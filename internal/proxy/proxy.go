@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"downpour/internal/downloader"
+)
+
+// headers that only describe the connection to the proxy and are never forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Server is an HTTP forward proxy. Large GETs of rangeable files are fetched with parallel range
+// requests and streamed back in order, everything else (including HTTPS tunnels) passes through
+type Server struct {
+	Transport *downloader.Transport
+	CacheDir  string    // finished large files are kept here keyed by URL and ETag, no cache when empty
+	Log       io.Writer // one line per request, nothing when nil
+}
+
+func NewServer() *Server {
+	// the proxy's own environment may point at the proxy, upstream requests always go direct
+	upstream := http.DefaultTransport.(*http.Transport).Clone()
+	upstream.Proxy = nil
+	// compressed bodies are handed to the client as they are
+	upstream.DisableCompression = true
+
+	return &Server{Transport: downloader.NewTransport(upstream)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		s.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "downpour proxy only answers proxy requests", http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+
+	if r.Method == http.MethodGet && s.cacheable(out) && s.serveCached(w, out) {
+		return
+	}
+
+	start := time.Now()
+	resp, err := s.Transport.RoundTrip(out)
+	if err != nil {
+		s.logf("%s %s - %v", r.Method, r.URL, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	mode := "passthrough"
+	body := io.Reader(resp.Body)
+	if s.Transport.Splittable(out, resp) {
+		mode = "accelerated"
+		if cache := s.cacheWriter(out, resp); cache != nil {
+			defer cache.discard()
+			body = io.TeeReader(resp.Body, cache)
+			defer func() {
+				if cache.complete(resp.ContentLength) {
+					s.logf("cached %s", r.URL)
+				}
+			}()
+		}
+	}
+
+	removeHopHeaders(resp.Header)
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	n, err := io.Copy(w, body)
+	if err != nil {
+		s.logf("%s %s - %s, %d bytes in %v: %v", r.Method, r.URL, mode, n, time.Since(start).Round(time.Millisecond), err)
+		return
+	}
+	s.logf("%s %s - %s, %d bytes in %v", r.Method, r.URL, mode, n, time.Since(start).Round(time.Millisecond))
+}
+
+// <== Helper Functions ==>
+
+// tunnel connects the client to the target of a CONNECT, the encrypted stream can only be passed through
+func (s *Server) tunnel(w http.ResponseWriter, r *http.Request) {
+	target, err := net.DialTimeout("tcp", r.Host, downloader.DefaultTimeouts.Connect)
+	if err != nil {
+		s.logf("CONNECT %s - %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		target.Close()
+		http.Error(w, "tunnelling is not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		target.Close()
+		return
+	}
+	s.logf("CONNECT %s - tunnel", r.Host)
+	fmt.Fprint(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// bytes the client sent right after the CONNECT are already buffered
+		io.Copy(target, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, target)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	target.Close()
+	<-done
+}
+
+// cacheable tells whether a request may be answered from the cache or stored in it, the response to
+// one with credentials may be meant for that client only
+func (s *Server) cacheable(out *http.Request) bool {
+	return s.CacheDir != "" && out.Header.Get("Authorization") == "" && out.Header.Get("Cookie") == ""
+}
+
+// serveCached answers from the cache if it holds the current version of the file, Range requests
+// included. It returns false when the request has to go upstream
+func (s *Server) serveCached(w http.ResponseWriter, out *http.Request) bool {
+	// only a URL with some version in the cache is worth asking upstream which version is current
+	if _, err := os.Stat(s.urlDir(out.URL.String())); err != nil {
+		return false
+	}
+
+	head := out.Clone(out.Context())
+	head.Method = http.MethodHead
+	head.Header.Del("Range")
+	head.Header.Del("If-Range")
+	resp, err := s.Transport.Base.RoundTrip(head)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	path := s.cachePath(out.URL.String(), resp)
+	if path == "" {
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil || stat.Size() != resp.ContentLength {
+		return false
+	}
+
+	removeHopHeaders(resp.Header)
+	copyHeader(w.Header(), resp.Header)
+	s.logf("%s %s - cache hit", out.Method, out.URL)
+	http.ServeContent(w, out, "", stat.ModTime(), file)
+	return true
+}
+
+// cachePath names the cache file of a version of url, empty if the response has nothing to tell
+// versions apart or varies with headers of the request
+func (s *Server) cachePath(url string, resp *http.Response) string {
+	if resp.Header.Get("Vary") != "" {
+		return ""
+	}
+	version := resp.Header.Get("ETag")
+	if version == "" {
+		version = resp.Header.Get("Last-Modified")
+	}
+	if version == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(version))
+	return filepath.Join(s.urlDir(url), hex.EncodeToString(sum[:]))
+}
+
+// urlDir holds the cached versions of url
+func (s *Server) urlDir(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(s.CacheDir, hex.EncodeToString(sum[:]))
+}
+
+// cacheWriter collects the body in a temporary file that only replaces the cache entry once it is complete
+func (s *Server) cacheWriter(out *http.Request, resp *http.Response) *cacheFile {
+	if !s.cacheable(out) {
+		return nil
+	}
+	path := s.cachePath(out.URL.String(), resp)
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".partial-*")
+	if err != nil {
+		return nil
+	}
+	return &cacheFile{file: tmp, path: path}
+}
+
+type cacheFile struct {
+	file    *os.File
+	path    string
+	written int64
+	failed  bool
+}
+
+// Write never fails so a full disk only costs the cache entry, not the client's download
+func (c *cacheFile) Write(p []byte) (int, error) {
+	if !c.failed {
+		n, err := c.file.Write(p)
+		c.written += int64(n)
+		c.failed = err != nil
+	}
+	return len(p), nil
+}
+
+// complete moves the file into the cache if all size bytes made it
+func (c *cacheFile) complete(size int64) bool {
+	if c.failed || c.written != size {
+		return false
+	}
+	if err := c.file.Close(); err != nil {
+		return false
+	}
+	if err := os.Rename(c.file.Name(), c.path); err != nil {
+		return false
+	}
+	c.file = nil
+	return true
+}
+
+// discard removes the temporary file unless it was moved into the cache
+func (c *cacheFile) discard() {
+	if c.file == nil {
+		return
+	}
+	c.file.Close()
+	os.Remove(c.file.Name())
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Log == nil {
+		return
+	}
+	fmt.Fprintf(s.Log, "%s %s\n", time.Now().Format("2006/01/02 15:04:05"), fmt.Sprintf(format, args...))
+}
+
+func removeHopHeaders(header http.Header) {
+	// headers named in Connection are hop-by-hop as well
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+func copyHeader(dst http.Header, src http.Header) {
+	for key, values := range src {
+		for _, v := range values {
+			dst.Add(key, v)
+		}
+	}
+}
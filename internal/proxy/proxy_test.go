@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	data := bytes.Repeat([]byte("downpour"), 64*1024)
+	tests := []struct {
+		name     string
+		header   http.Header // sent by the client
+		vary     string      // sent by the server
+		wantHEAD int64       // HEAD requests upstream for both GETs
+		wantHit  bool        // the second GET is answered from the cache
+	}{
+		{"plain", nil, "", 1, true},
+		{"authorization", http.Header{"Authorization": {"Bearer secret"}}, "", 0, false},
+		{"cookie", http.Header{"Cookie": {"session=1"}}, "", 0, false},
+		{"vary", nil, "Accept-Language", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var heads, gets atomic.Int64
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					heads.Add(1)
+				} else {
+					gets.Add(1)
+				}
+				w.Header().Set("ETag", `"v1"`)
+				if tt.vary != "" {
+					w.Header().Set("Vary", tt.vary)
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			}))
+			defer upstream.Close()
+
+			s := NewServer()
+			s.CacheDir = t.TempDir()
+			s.Transport.Threshold = 1
+
+			for i := range 2 {
+				before := gets.Load()
+				req := httptest.NewRequest(http.MethodGet, upstream.URL+"/file", nil)
+				for key, values := range tt.header {
+					req.Header[key] = values
+				}
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, req)
+
+				if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+					t.Fatalf("request %d got status %d and %d bytes, want the whole file", i+1, rec.Code, rec.Body.Len())
+				}
+				if hit := gets.Load() == before; i == 1 && hit != tt.wantHit {
+					t.Errorf("second request answered from the cache = %v, want %v", hit, tt.wantHit)
+				}
+			}
+			if got := heads.Load(); got != tt.wantHEAD {
+				t.Errorf("sent %d HEAD requests upstream, want %d", got, tt.wantHEAD)
+			}
+		})
+	}
+}
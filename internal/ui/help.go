@@ -6,7 +6,16 @@ func PrintHelp() {
 	fmt.Print(`downpour - high-performance concurrent download manager
 
 Usage:
-  downpour <url> [options]
+  downpour [options] <url> [mirror-url...]
+  downpour replay <telemetry.csv> [--policy name[,name...]]
+  downpour proxy [--listen 127.0.0.1:8118] [--cache dir] [--min-size MB] [-w workers]
+
+Commands:
+  replay               Feed a -tel recording through the health policies (all by default), report which
+                       workers each would have restarted and how much sooner the download might have finished
+  proxy                HTTP forward proxy: GETs of --min-size (16MB) or more from servers with range support are
+                       fetched with parallel ranges and streamed back, --cache keeps finished files for later
+                       requests, everything else (and HTTPS) passes through
 
 Options:
   -h,   --help         Show this help message
@@ -14,5 +23,22 @@ Options:
   -hl,  --httplog      Generate an HTTP trace logfile
   -c,   --checksum     Verify the downloaded file against this expected hash
   -a,   --algorithm    Specify the cryptographic algorithm for validation (e.g., sha256, md5)
+  -o,   --output       Write to this file or directory instead of the working directory, - writes to stdout
+        --serve        Serve the file over HTTP on this address (e.g. :8080) while it downloads, reads of missing
+                       bytes wait for them and are fetched first
+        --sequential   Download front to back: the lowest missing ranges go to the fastest workers and work stays
+                       within 64MB of the contiguous prefix, so media and archives are usable from the start
+  -m,   --mirror       Additional mirror URL serving the same file (repeatable)
+  -w,   --workers      Maximum number of parallel workers, the pool grows up to it while it pays off (default 32)
+        --health-policy      How slow workers are picked for a restart: trimmed-mean (default), mad or percentile
+        --retries      Attempts per chunk before giving up (default 5)
+        --retry-budget Retries shared by all workers before giving up (default 100)
+        --max-failures Ranges that may run out of retries and be re-queued before giving up (default 10)
+        --connect-timeout    TCP connect timeout, 0 disables (default 10s)
+        --tls-timeout        TLS handshake timeout, 0 disables (default 10s)
+        --ttfb-timeout       Time to wait for the response headers, 0 disables (default 15s)
+        --stall-timeout      Drop and retry a response that sends no bytes for this long, 0 disables (default 10s)
+        --restart-on-change  Start over instead of failing if the remote file changes mid-download
+        --discard-partial    Delete the partial file on cancel or failure instead of keeping it for resume
 `)
 }
@@ -1,8 +1,10 @@
 package ui
 
 import (
+	"context"
 	"downpour/internal/downloader"
 	"downpour/internal/utils"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -11,26 +13,22 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-type ProgressMsg struct {
-	Bytes int
-}
-
-type DoneMsg struct{}
-
-type ErrorMsg struct {
-	Err error
-}
-
 type TickMsg struct{}
 
-type VerifyingMsg struct{}
+// Source is what the view polls for worker statistics, a RangeDownloadInfo or a ParallelReader
+type Source interface {
+	Snapshot() downloader.DownloadSnapshot
+}
 
 // snapshot of the current state of the app
 type Model struct {
 	filename       string
 	totalSize      int64
 	acceptRange    bool
-	rdi            *downloader.RangeDownloadInfo
+	source         Source                      // nil for a streamed download
+	checksum       string                      // algorithm the file is verified with, if any
+	serving        string                      // URL the file is served on while it downloads, if any
+	stats          downloader.DownloadSnapshot // taken on every tick, the view never reads the source directly
 	downloaded     int64
 	progress       progress.Model
 	status         string
@@ -40,6 +38,8 @@ type Model struct {
 	elapsed        time.Duration
 	lastDownloaded int64
 	currentSpeed   float64
+	resumedBytes   int64
+	cancel         context.CancelFunc
 }
 
 const asciiLogo = `
@@ -51,23 +51,33 @@ const asciiLogo = `
                          /_/
 `
 
-func InitialModel(filename string, total int64, acceptRange bool, rdi *downloader.RangeDownloadInfo) Model {
+func InitialModel(filename string, total int64, acceptRange bool, source Source, checksum string, serving string, cancel context.CancelFunc) Model {
 	p := progress.New(progress.WithDefaultGradient())
 	workerCount := 0
-	if rdi != nil {
-		workerCount = rdi.Workers.Limit
+	var resumedBytes int64
+	var stats downloader.DownloadSnapshot
+	if source != nil {
+		stats = source.Snapshot()
+		workerCount = stats.WorkerLimit
+		resumedBytes = stats.BytesWritten
 	}
 	return Model{
-		filename:     filename,
-		totalSize:    total,
-		acceptRange:  acceptRange,
-		rdi:          rdi,
-		downloaded:   0,
-		progress:     p,
-		status:       "downloading",
-		workerSpeeds: make([]float64, workerCount),
-		err:          nil,
-		startTime:    time.Now(),
+		filename:       filename,
+		totalSize:      total,
+		acceptRange:    acceptRange,
+		source:         source,
+		checksum:       checksum,
+		serving:        serving,
+		stats:          stats,
+		downloaded:     resumedBytes,
+		lastDownloaded: resumedBytes,
+		resumedBytes:   resumedBytes,
+		progress:       p,
+		status:         "downloading",
+		workerSpeeds:   make([]float64, workerCount),
+		err:            nil,
+		startTime:      time.Now(),
+		cancel:         cancel,
 	}
 }
 
@@ -81,11 +91,18 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		switch msg.String() {
-		case "q":
+		case "q", "ctrl+c":
+			if m.status == "downloading" && m.cancel != nil {
+				// let the download stop its workers and close the file, it reports back with a downloader.Failed event
+				m.status = "cancelling"
+				m.cancel()
+				return m, nil
+			}
 			return m, tea.Quit
 		}
-	case ProgressMsg:
-		m.downloaded += int64(msg.Bytes)
+	case downloader.Progress:
+		// workers commit concurrently, so totals can arrive slightly out of order
+		m.downloaded = max(m.downloaded, msg.Total)
 		if m.totalSize > 0 {
 			percent := float64(m.downloaded) / float64(m.totalSize)
 			cmd := m.progress.SetPercent(percent)
@@ -93,37 +110,30 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return m, nil
 	case TickMsg:
-		if m.rdi == nil || m.status == "error" {
+		if m.status == "error" || m.status == "cancelled" {
 			return m, nil
 		}
-		// Global Updates
-		currentTotal := m.rdi.BytesWritten.Load()
-		delta := currentTotal - m.lastDownloaded
+		// the byte count comes from Progress events, the worker grid from a snapshot
+		if m.source != nil {
+			m.stats = m.source.Snapshot()
+		}
+		delta := m.downloaded - m.lastDownloaded
 		instantSpeed := float64(delta) * 2
 		m.currentSpeed = (0.6 * m.currentSpeed) + (0.4 * instantSpeed)
-		m.downloaded = currentTotal
-		m.lastDownloaded = currentTotal
+		m.lastDownloaded = m.downloaded
 
 		// send next tick
-		nextTick := tea.Tick(500*time.Millisecond, func(t time.Time) tea.Msg { return TickMsg{} })
-
-		// Update Global progress bar percentage
-		if m.totalSize > 0 {
-			percent := float64(m.downloaded) / float64(m.totalSize)
-			return m, tea.Batch(m.progress.SetPercent(percent), nextTick)
-		}
-		return m, nextTick
-	case DoneMsg:
+		return m, tea.Tick(500*time.Millisecond, func(t time.Time) tea.Msg { return TickMsg{} })
+	case downloader.Completed:
 		m.status = "done"
-		m.elapsed = time.Since(m.startTime)
+		m.elapsed = msg.Elapsed
+		m.downloaded = max(m.downloaded, msg.Bytes)
 		return m, tea.Quit
-	case VerifyingMsg:
+	case downloader.VerifyStarted:
 		m.status = "verifying"
 		return m, nil
-	case ErrorMsg:
-		m.err = msg.Err
-		m.status = "error"
-		return m, tea.Quit
+	case downloader.Failed:
+		return m.fail(msg.Err)
 	}
 
 	var cmd tea.Cmd
@@ -134,27 +144,36 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+func (m Model) fail(err error) (tea.Model, tea.Cmd) {
+	m.err = err
+	m.status = "error"
+	if errors.Is(err, downloader.ErrCancelled) {
+		m.status = "cancelled"
+	}
+	return m, tea.Quit
+}
+
 func (m Model) View() string {
 	if m.status == "error" {
 		return fmt.Sprintf("\nFatal Error: %v\n\n  Press 'q' to quit", m.err)
-	} else if m.rdi == nil {
-		return "\nFatal Error: RangeDownloadInfo is nil\n\n  Press 'q' to quit"
+	} else if m.status == "cancelled" {
+		return fmt.Sprintf("\nDownload Cancelled\n\n    %v\n", m.err)
 	}
 
 	if m.status == "done" {
-		avgSpeed := float64(m.downloaded) / m.elapsed.Seconds()
+		avgSpeed := float64(m.downloaded-m.resumedBytes) / m.elapsed.Seconds()
 
 		filenameDisplay := m.filename
-		if m.rdi != nil && m.rdi.Checksum != nil {
-			filenameDisplay = fmt.Sprintf("%s (%s checksum verified)", m.filename, m.rdi.Checksum.AlgoName)
+		if m.checksum != "" {
+			filenameDisplay = fmt.Sprintf("%s (%s checksum verified)", m.filename, m.checksum)
 		}
 
 		return fmt.Sprintf(
 			"%s\nDownload Complete!\n\n    Filename: %s\n    Downloaded: %s (Filesize: %s)\n    Time: %.2fs\n    Average Speed: %s\n\n  Press 'q' to exit",
 			asciiLogo,
 			filenameDisplay,
-			utils.FormatSpeedString(float64(m.rdi.BytesWritten.Load()), "B"),
-			utils.FormatSpeedString(float64(m.rdi.TotalSize), "B"),
+			utils.FormatSpeedString(float64(m.downloaded), "B"),
+			utils.FormatSpeedString(float64(m.totalSize), "B"),
 			m.elapsed.Seconds(),
 			utils.FormatSpeedString(avgSpeed, "B/s"),
 		)
@@ -183,45 +202,86 @@ func (m Model) View() string {
 		etdStr = "ETA: Calculating..."
 	}
 
+	footer := "Press 'q' to quit"
+	if m.status == "cancelling" {
+		footer = "Cancelling, waiting for the workers to stop... (press 'q' again to force quit)"
+	}
+
 	return fmt.Sprintf(
-		"%s\nFile: %s\nMode: %s\n\nProgress: %s\n\nSize: %-30s\nSpeed: %-29s%s\nWorker's Baseline Speed:%s\n\nIndividual Worker Speeds:%s\n\nPress 'q' to quit",
+		"%s\nFile: %s\nMode: %s%s\n\nProgress: %s\n\nSize: %-30s\nSpeed: %-29s%s\nWorker's Baseline Speed:%s\n\nIndividual Worker Speeds:%s\n\n%s",
 		asciiLogo,
 		m.filename,
 		header,
+		m.formatMirrors()+m.formatServing(),
 		m.progress.View(),
 		fmt.Sprintf("%s / %s", utils.FormatSpeedString(float64(m.downloaded), "B"), utils.FormatSpeedString(float64(m.totalSize), "B")),
 		speedStr,
 		etdStr,
-		utils.FormatSpeedString(m.rdi.WorkerBaselineSpeed, "B/s"),
+		utils.FormatSpeedString(m.stats.BaselineSpeed, "B/s"),
 		func() string {
-			if !m.acceptRange || m.rdi == nil {
+			if !m.acceptRange || m.source == nil {
 				return " N/A (Streaming)"
 			}
-			return m.formatWorkerGrid(m.rdi)
+			return m.formatWorkerGrid()
 		}(),
+		footer,
 	)
 }
 
-func (m Model) formatWorker(workerInfo *downloader.WorkerInfo) string {
+func (m Model) formatWorker(workerInfo downloader.WorkerSnapshot) string {
 	var speedStr string
 	switch workerInfo.Status {
 	case downloader.WorkerStatusDone:
 		speedStr = "IDLE"
 	case downloader.WorkerStatusRestarting:
 		speedStr = "RESTARTING"
+	case downloader.WorkerStatusParked:
+		speedStr = "OFF"
 	default:
 		speedStr = utils.FormatSpeedString(workerInfo.Speed, "B/s")
 	}
 	return fmt.Sprintf("W%d - %8s [chunk %5s]", workerInfo.ID, speedStr, fmt.Sprintf("#%d", workerInfo.Chunk.Index))
 }
 
-func (m Model) formatWorkerGrid(rdi *downloader.RangeDownloadInfo) string {
-	rows := len(rdi.Workers.Slice) / 2
+func (m Model) formatServing() string {
+	if m.serving == "" {
+		return ""
+	}
+	return fmt.Sprintf("\nServing: %s", m.serving)
+}
+
+func (m Model) formatMirrors() string {
+	mirrors := m.stats.Mirrors
+	if !m.acceptRange || len(mirrors) < 2 {
+		return ""
+	}
+
 	var sb strings.Builder
-	for i := 0; i < (rows * 2); i += 2 {
+	fmt.Fprintf(&sb, "\nMirrors:")
+	for _, mirror := range mirrors {
+		state := utils.FormatSpeedString(mirror.Speed, "B/s")
+		if mirror.Disabled {
+			state = "DISABLED"
+		} else if time.Now().Before(mirror.DemotedUntil) {
+			state = "DEMOTED"
+		}
+		fmt.Fprintf(&sb, "\n  %-50s %10s [%d active]", mirror.URL, state, mirror.Active)
+	}
+	return sb.String()
+}
+
+func (m Model) formatWorkerGrid() string {
+	workers := m.stats.Workers
+	var sb strings.Builder
+	fmt.Fprintf(&sb, " %d/%d active", m.stats.ActiveWorkers, m.stats.WorkerLimit)
+	for i := 0; i < len(workers); i += 2 {
 		fmt.Fprintf(&sb, "\n")
-		firstWorkerStr := m.formatWorker(rdi.Workers.Slice[i])
-		secondWorkerStr := m.formatWorker(rdi.Workers.Slice[i+1])
+		firstWorkerStr := m.formatWorker(workers[i])
+		if i+1 == len(workers) {
+			fmt.Fprintf(&sb, "%s", firstWorkerStr)
+			break
+		}
+		secondWorkerStr := m.formatWorker(workers[i+1])
 		fmt.Fprintf(&sb, "%-36s%s", firstWorkerStr, secondWorkerStr)
 	}
 
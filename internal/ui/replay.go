@@ -0,0 +1,54 @@
+package ui
+
+import (
+	"fmt"
+
+	"downpour/internal/downloader"
+	"downpour/internal/utils"
+)
+
+// PrintReplayReport prints one summary line per policy, followed by the restarts each would have made
+func PrintReplayReport(t *downloader.Telemetry, reports []downloader.ReplayReport) {
+	if len(reports) == 0 {
+		return
+	}
+	first := reports[0]
+	fmt.Printf("Replayed %d samples: %s in %.0fs with %d workers\n\n",
+		first.Samples,
+		utils.FormatSpeedString(float64(first.TotalBytes), "B"),
+		first.RecordedDuration.Seconds(),
+		t.Workers,
+	)
+
+	fmt.Printf("  %-14s %8s %12s %16s\n", "Policy", "Restarts", "Estimated", "Saving")
+	for _, r := range reports {
+		saving := r.RecordedDuration - r.EstimatedDuration
+		percent := 0.0
+		if r.RecordedDuration > 0 {
+			percent = 100 * saving.Seconds() / r.RecordedDuration.Seconds()
+		}
+		fmt.Printf("  %-14s %8d %11.1fs %9.1fs (%4.1f%%)\n",
+			r.Policy, len(r.Restarts), r.EstimatedDuration.Seconds(), saving.Seconds(), percent)
+	}
+
+	for _, r := range reports {
+		if len(r.Restarts) == 0 {
+			continue
+		}
+		fmt.Printf("\nRestarts by %s:\n", r.Policy)
+		for _, restart := range r.Restarts {
+			fmt.Printf("  t=%5.0fs  W%-3d %10s (baseline %s)\n",
+				restart.At.Seconds(),
+				restart.WorkerID,
+				utils.FormatSpeedString(restart.Speed, "B/s"),
+				utils.FormatSpeedString(restart.Baseline, "B/s"),
+			)
+		}
+		if r.IgnoredActions > 0 {
+			fmt.Printf("  (%d other actions not simulated)\n", r.IgnoredActions)
+		}
+	}
+
+	fmt.Println("\nEstimates assume a restarted worker reconnects within 1s at the baseline speed and that the")
+	fmt.Println("link never goes faster than the best throughput seen in the recording.")
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"net/http"
-	"net/url"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"downpour/internal/downloader"
@@ -19,8 +22,22 @@ import (
 var version = "dev"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "proxy" {
+		runProxy(os.Args[2:])
+		return
+	}
+
 	var helpFlag, httpLogFlag, telemetryFlag, versionFlag bool
-	var expectedHash, algorithm string
+	var expectedHash, algorithm, healthPolicyFlag string
+	var mirrorFlag urlList
+	var retriesFlag, retryBudgetFlag, maxFailuresFlag, workersFlag int
+	var restartOnChangeFlag, discardPartialFlag, sequentialFlag bool
+	var outputFlag, serveFlag string
+	var timeouts downloader.Timeouts
 
 	flag.BoolVar(&helpFlag, "help", false, "Show help message")
 	flag.BoolVar(&helpFlag, "h", false, "Show help message (shorthand)")
@@ -37,6 +54,34 @@ func main() {
 	flag.StringVar(&algorithm, "algorithm", "", "Cryptographic algorithm")
 	flag.StringVar(&algorithm, "a", "", "Cryptographic algorithm (shorthand)")
 
+	flag.Var(&mirrorFlag, "mirror", "Additional mirror URL for the same file (repeatable)")
+	flag.Var(&mirrorFlag, "m", "Additional mirror URL for the same file (shorthand)")
+
+	flag.IntVar(&retriesFlag, "retries", downloader.DefaultRetryPolicy.MaxRetries, "Attempts per chunk before giving up")
+	flag.IntVar(&retryBudgetFlag, "retry-budget", downloader.DefaultRetryPolicy.Budget, "Retries shared by all workers before giving up")
+	flag.IntVar(&maxFailuresFlag, "max-failures", downloader.DefaultErrorPolicy.MaxFailures, "Failed ranges tolerated before the download gives up")
+
+	flag.DurationVar(&timeouts.Connect, "connect-timeout", downloader.DefaultTimeouts.Connect, "TCP connect timeout (0 disables)")
+	flag.DurationVar(&timeouts.TLSHandshake, "tls-timeout", downloader.DefaultTimeouts.TLSHandshake, "TLS handshake timeout (0 disables)")
+	flag.DurationVar(&timeouts.FirstByte, "ttfb-timeout", downloader.DefaultTimeouts.FirstByte, "Time to wait for the response headers (0 disables)")
+	flag.DurationVar(&timeouts.Stall, "stall-timeout", downloader.DefaultTimeouts.Stall, "Drop a response that sends no bytes for this long (0 disables)")
+
+	flag.StringVar(&healthPolicyFlag, "health-policy", "trimmed-mean", "Health monitor policy: "+strings.Join(downloader.HealthPolicyNames(), ", "))
+
+	flag.IntVar(&workersFlag, "workers", 32, "Maximum number of parallel workers")
+	flag.IntVar(&workersFlag, "w", 32, "Maximum number of parallel workers (shorthand)")
+
+	flag.StringVar(&outputFlag, "output", "", "Output file or directory, - writes to stdout")
+	flag.StringVar(&outputFlag, "o", "", "Output file or directory, - writes to stdout (shorthand)")
+
+	flag.StringVar(&serveFlag, "serve", "", "Serve the file over HTTP on this address while it downloads")
+
+	flag.BoolVar(&sequentialFlag, "sequential", false, "Download the file front to back so it is usable from the start")
+
+	flag.BoolVar(&restartOnChangeFlag, "restart-on-change", false, "Start over if the remote file changes mid-download")
+
+	flag.BoolVar(&discardPartialFlag, "discard-partial", false, "Delete the partial file instead of keeping it for resume")
+
 	flag.BoolVar(&versionFlag, "version", false, "Print version")
 	flag.BoolVar(&versionFlag, "v", false, "Print version (shorthand)")
 
@@ -52,132 +97,216 @@ func main() {
 		return
 	}
 
-	if len(flag.Args()) != 1 {
+	urls := append(flag.Args(), mirrorFlag...)
+	if len(urls) == 0 {
 		ui.PrintHelp()
 		return
 	}
 
-	urlString := flag.Arg(0)
-
-	req, _ := http.NewRequest("GET", urlString, nil)
-	req.Header.Set("User-Agent", "Mozilla/5.0 Downpour/1.0")
-	req.Header.Set("Range", "bytes=0-0")
+	urlString := urls[0]
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	healthPolicy, err := downloader.HealthPolicyByName(healthPolicyFlag)
 	if err != nil {
-		startErrorUI(fmt.Errorf("network error: %w", err))
+		startErrorUI(err)
 		return
 	}
-	defer resp.Body.Close()
 
-	// extract stuff from resp
-	var totalSize int64
-	var acceptRangeBool bool
+	primary, err := downloader.Probe(context.Background(), urlString, nil)
+	if err != nil {
+		startErrorUI(err)
+		return
+	}
+	// a server that does not say how big the file is can only be streamed
+	acceptRangeBool := primary.AcceptRange && primary.TotalSize > 0
+	totalSize := primary.TotalSize
 
-	if resp.StatusCode == http.StatusPartialContent {
-		acceptRangeBool = true
-		contentRange := resp.Header.Get("Content-Range")
-		if contentRange != "" {
-			parts := strings.Split(contentRange, "/")
-			if len(parts) == 2 {
-				fmt.Sscanf(parts[1], "%d", &totalSize)
-			}
+	// every mirror has to serve the exact same file as the primary URL
+	mirrors := downloader.NewMirrorSet([]*downloader.Mirror{{URL: urlString, Validators: primary.Validators}})
+	if acceptRangeBool {
+		var skipped []error
+		mirrors, skipped, err = downloader.ProbeMirrors(context.Background(), primary, urls[1:], nil)
+		for _, skip := range skipped {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", skip)
+		}
+		if err != nil {
+			startErrorUI(err)
+			return
 		}
-	} else {
-		// fallback
-		totalSize = resp.ContentLength
-		acceptRangeBool = false
 	}
 
-	parsedUrl, err := url.Parse(urlString)
-	if err != nil {
-		panic(err)
+	filename := primary.Filename
+
+	var checksum *downloader.ChecksumInfo
+	if algorithm != "" && expectedHash != "" {
+		checksum, err = downloader.NewChecksumInfo(algorithm, expectedHash)
+		if err != nil {
+			startErrorUI(err)
+			return
+		}
 	}
-	filename := downloader.GetFileName(parsedUrl, resp)
 
-	statusFlags := downloader.StatusFlags{
-		EnableTrace:     httpLogFlag,
-		EnableTelemetry: telemetryFlag,
+	// "-o -" writes the file to stdout, the UI moves to stderr to stay out of the way
+	toStdout := outputFlag == "-"
+	displayName := "stdout"
+	if !toStdout {
+		filename = downloader.OutputPath(outputFlag, filename)
+		displayName = filename
+		if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+			startErrorUI(err)
+			return
+		}
 	}
 
-	rdi, initErr := downloader.InitRangeDownloadInfo(filename, totalSize, urlString, statusFlags)
-	if initErr != nil {
-		startErrorUI(initErr)
+	// a reader of a missing region has to be able to ask for it, so only a range download to a file can be served
+	if serveFlag != "" && (toStdout || !acceptRangeBool) {
+		startErrorUI(errors.New("--serve needs a server with range support and a file to download to"))
 		return
 	}
-	m := ui.InitialModel(filename, totalSize, acceptRangeBool, rdi)
-	p := tea.NewProgram(m)
 
-	if rdi.StatusFlags.EnableTelemetry {
-		ctx, cancelTelemetry := context.WithCancel(context.Background())
-		defer cancelTelemetry()
-		go rdi.StartTelemetry(ctx)
+	// SIGINT/SIGTERM and 'q' in the UI all cancel the same root context, a second signal kills the process
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	context.AfterFunc(sigCtx, stopSignals)
+	ctx, cancel := context.WithCancel(sigCtx)
+	defer cancel()
+
+	var source ui.Source
+	var events *downloader.EventBus
+	var download func()
+	var downloadErr error
+	var serveURL string
+	var verifiedWith string
+	if checksum != nil {
+		verifiedWith = checksum.AlgoName
 	}
-
-	ctx, cancelHealthMonitor := context.WithCancel(context.Background())
-	defer cancelHealthMonitor()
-	go rdi.StartHealthMonitor(ctx)
-
-	// Move to InitRangeDownloadInfo()
-	if algorithm != "" && expectedHash != "" {
-		algo := strings.ToLower(algorithm)
-		hashStr := expectedHash
-
-		algoInfo, exists := downloader.SupportedChecksum[algo]
-		if !exists {
-			p.Send(ui.ErrorMsg{Err: fmt.Errorf("Error: Algorithm '%s' is not supported\n", algo)})
+	statusFlags := downloader.StatusFlags{
+		EnableTrace:     httpLogFlag,
+		EnableTelemetry: telemetryFlag,
+	}
+	switch {
+	case toStdout && acceptRangeBool:
+		// workers fetch ahead of the writer and the bytes come out in order, nothing touches the disk
+		pr := downloader.NewParallelReader(urlString, totalSize, primary.Validators)
+		pr.Mirrors = mirrors
+		pr.Checksum = checksum
+		pr.Workers = max(workersFlag, 1)
+		pr.RetryPolicy.MaxRetries = max(retriesFlag, 1)
+		pr.RetryPolicy.Budget = max(retryBudgetFlag, 0)
+		pr.Timeouts = timeouts
+		pr.HealthPolicy = healthPolicy
+		source, events = pr, pr.Events
+		// a reader that goes away has to end the download through the UI, not kill the process mid-render
+		signal.Ignore(syscall.SIGPIPE)
+		download = func() {
+			pr.Start(ctx)
+			_, err := io.Copy(os.Stdout, pr)
+			pr.CloseWithError(err)
 		}
-
-		if len(hashStr) != algoInfo.ChecksumLen {
-			p.Send(ui.ErrorMsg{Err: fmt.Errorf("Error: Invalid %s checksum length. Expected %d characters, got %d\n", algo, algoInfo.ChecksumLen, len(hashStr))})
+	case acceptRangeBool:
+		rdi, initErr := downloader.InitRangeDownloadInfo(filename, totalSize, urlString, primary.Validators, statusFlags)
+		if initErr != nil {
+			startErrorUI(initErr)
+			return
 		}
-
-		rdi.Checksum = &downloader.ChecksumInfo{
-			ExpectedHash: strings.ToLower(hashStr),
-			AlgoName:     algo,
-			Algo:         algoInfo,
+		rdi.Mirrors = mirrors
+		rdi.Checksum = checksum
+		rdi.SetWorkerLimit(workersFlag)
+		rdi.RetryPolicy.MaxRetries = max(retriesFlag, 1)
+		rdi.RetryPolicy.Budget = max(retryBudgetFlag, 0)
+		rdi.ErrorPolicy.MaxFailures = max(maxFailuresFlag, 0)
+		rdi.Timeouts = timeouts
+		rdi.HealthPolicy = healthPolicy
+		rdi.RestartOnChange = restartOnChangeFlag
+		rdi.DiscardPartial = discardPartialFlag
+		rdi.Sequential = sequentialFlag
+		if serveFlag != "" {
+			pf, err := rdi.OpenPartial()
+			if err == nil {
+				serveURL, err = startServer(serveFlag, pf, filename)
+			}
+			if err != nil {
+				startErrorUI(err)
+				return
+			}
+		}
+		source, events = rdi, rdi.Events
+		download = func() {
+			go rdi.StartHealthMonitor(ctx)
+			downloadErr = rdi.RangeDownload(ctx)
+		}
+	default:
+		// a server without range support gets a single request, resumed where the server allows it
+		sdi, initErr := downloader.InitStreamDownloadInfo(filename, urlString, primary.Validators, statusFlags)
+		if initErr != nil {
+			startErrorUI(initErr)
+			return
+		}
+		if toStdout {
+			sdi.Writer = os.Stdout
+			signal.Ignore(syscall.SIGPIPE)
+		}
+		sdi.Checksum = checksum
+		sdi.RetryPolicy.MaxRetries = max(retriesFlag, 1)
+		sdi.Timeouts = timeouts
+		sdi.DiscardPartial = discardPartialFlag
+		events = sdi.Events
+		download = func() {
+			downloadErr = sdi.StreamDownload(ctx)
 		}
 	}
 
-	if acceptRangeBool {
-		go rdi.RangeDownload(
-			func() {
-				p.Send(ui.DoneMsg{})
-			},
-
-			func() {
-				p.Send(ui.VerifyingMsg{})
-			},
+	m := ui.InitialModel(displayName, totalSize, acceptRangeBool, source, verifiedWith, serveURL, cancel)
+	programOptions := []tea.ProgramOption{tea.WithoutSignalHandler()}
+	if toStdout {
+		programOptions = append(programOptions, tea.WithOutput(os.Stderr))
+	}
+	p := tea.NewProgram(m, programOptions...)
 
-			func(err error) {
-				p.Send(ui.ErrorMsg{Err: err})
-			},
-		)
-	} else {
-		go downloader.StreamDownload(
-			*parsedUrl,
+	// the UI is one more subscriber of the download's events
+	events.Subscribe(downloader.SubscriberFunc(func(e downloader.Event) {
+		p.Send(e)
+	}))
 
-			func(n int64) {
-				p.Send(ui.ProgressMsg{Bytes: int(n)})
-			},
+	downloadDone := make(chan struct{})
+	go func() {
+		defer close(downloadDone)
+		download()
+	}()
 
-			func() {
-				p.Send(ui.DoneMsg{})
-			},
+	if _, err := p.Run(); err != nil {
+		panic(err)
+	}
 
-			func(err error) {
-				p.Send(ui.ErrorMsg{Err: err})
-			},
-		)
+	// a forced quit can leave the download mid-cleanup, give it a moment to close the file and the logs
+	cancel()
+	select {
+	case <-downloadDone:
+		events.Close()
+	case <-time.After(5 * time.Second):
+		return
 	}
 
-	if _, err := p.Run(); err != nil {
-		panic(err)
+	// whatever is playing the file keeps reading it after the download is done
+	if serveURL != "" && downloadErr == nil {
+		fmt.Fprintf(os.Stderr, "Still serving %s, press Ctrl+C to stop\n", serveURL)
+		waitCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		<-waitCtx.Done()
+		stop()
 	}
 }
 
 // <== Helper Functions ==>
+type urlList []string
+
+func (u *urlList) String() string {
+	return strings.Join(*u, ",")
+}
+
+func (u *urlList) Set(value string) error {
+	*u = append(*u, value)
+	return nil
+}
+
 func startErrorUI(err error) {
 	fmt.Fprintf(os.Stderr, "\nFatal Error: %v\n", err)
 	os.Exit(1)
@@ -0,0 +1,346 @@
+// Package downpour downloads files with downpour's parallel range engine from inside another Go program.
+//
+//	client := downpour.NewClient(downpour.WithWorkers(16))
+//	h, err := client.Download("https://example.com/1GB.bin", downpour.WithOutput("out/")).Start(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	err = h.Wait()
+package downpour
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"downpour/internal/downloader"
+)
+
+// the events of a download, see the downloader package for what each one carries
+type (
+	Event           = downloader.Event
+	EventMeta       = downloader.EventMeta
+	Started         = downloader.Started
+	ChunkStarted    = downloader.ChunkStarted
+	ChunkCompleted  = downloader.ChunkCompleted
+	ChunkFailed     = downloader.ChunkFailed
+	RaceLost        = downloader.RaceLost
+	Progress        = downloader.Progress
+	Connected       = downloader.Connected
+	RetryScheduled  = downloader.RetryScheduled
+	MirrorDisabled  = downloader.MirrorDisabled
+	WorkerRestarted = downloader.WorkerRestarted
+	VerifyStarted   = downloader.VerifyStarted
+	Completed       = downloader.Completed
+	Failed          = downloader.Failed
+
+	Subscriber     = downloader.Subscriber
+	SubscriberFunc = downloader.SubscriberFunc
+
+	// RemoteFile is a remote file opened for random access, see Client.Open
+	RemoteFile = downloader.RemoteFile
+
+	// ParallelReader is a download read in order as a stream, see Client.Reader
+	ParallelReader = downloader.ParallelReader
+
+	// Snapshot is a consistent copy of the download's statistics
+	Snapshot       = downloader.DownloadSnapshot
+	WorkerSnapshot = downloader.WorkerSnapshot
+)
+
+// ErrCancelled is wrapped by the error of a download that was cancelled
+var ErrCancelled = downloader.ErrCancelled
+
+type config struct {
+	workers     int
+	chunkSize   int64
+	header      http.Header
+	algorithm   string
+	hash        string
+	output      string
+	mirrors     []string
+	retries     int
+	subscribers []Subscriber
+	cacheSize   int64
+	readahead   int
+	bufferSize  int64
+	sequential  bool
+}
+
+// Option configures a Client or a single Download, options given to Download override the client's
+type Option func(*config)
+
+// WithWorkers caps the number of parallel connections (default 32 for a Download)
+func WithWorkers(n int) Option {
+	return func(c *config) {
+		c.workers = n
+	}
+}
+
+// WithChunkSize fixes the size of the byte ranges handed to workers, by default they are sized to the
+// speed of each worker. It is clamped to 256KB - 32MB
+func WithChunkSize(size int64) Option {
+	return func(c *config) {
+		c.chunkSize = size
+	}
+}
+
+// WithHeader adds a header to every request, Range and If-Range are left to the download
+func WithHeader(key, value string) Option {
+	return func(c *config) {
+		if c.header == nil {
+			c.header = http.Header{}
+		}
+		c.header.Add(key, value)
+	}
+}
+
+// WithChecksum verifies the finished file against a hex encoded hash, algorithm is one of md5, sha1,
+// sha256, sha384 or sha512
+func WithChecksum(algorithm, hash string) Option {
+	return func(c *config) {
+		c.algorithm = algorithm
+		c.hash = hash
+	}
+}
+
+// WithOutput sets where the file is written. A directory (one that exists or a path ending in a
+// separator) gets the file under its remote name, the default is the remote name in the working directory
+func WithOutput(path string) Option {
+	return func(c *config) {
+		c.output = path
+	}
+}
+
+// WithMirrors spreads the download across more URLs serving the same file
+func WithMirrors(urls ...string) Option {
+	return func(c *config) {
+		c.mirrors = append(c.mirrors, urls...)
+	}
+}
+
+// WithRetries sets the attempts per chunk before it counts as failed (default 5)
+func WithRetries(n int) Option {
+	return func(c *config) {
+		c.retries = n
+	}
+}
+
+// WithSubscriber receives every event of the download, starting with Started
+func WithSubscriber(s Subscriber) Option {
+	return func(c *config) {
+		c.subscribers = append(c.subscribers, s)
+	}
+}
+
+// WithCacheSize caps the memory a RemoteFile keeps for cached blocks (default 64MB)
+func WithCacheSize(bytes int64) Option {
+	return func(c *config) {
+		c.cacheSize = bytes
+	}
+}
+
+// WithReadahead sets how many blocks a RemoteFile fetches ahead of a sequential reader (default 4)
+func WithReadahead(blocks int) Option {
+	return func(c *config) {
+		c.readahead = blocks
+	}
+}
+
+// WithBufferSize caps how far a ParallelReader's workers may run ahead of the reader (default 2 chunks per worker)
+func WithBufferSize(bytes int64) Option {
+	return func(c *config) {
+		c.bufferSize = bytes
+	}
+}
+
+// WithSequential downloads the file front to back so it is usable from the start, the lowest missing
+// ranges go to the fastest workers and work stays within 64MB of the contiguous prefix
+func WithSequential() Option {
+	return func(c *config) {
+		c.sequential = true
+	}
+}
+
+// Client holds the options shared by the downloads it starts
+type Client struct {
+	opts []Option
+}
+
+func NewClient(opts ...Option) *Client {
+	return &Client{opts: opts}
+}
+
+// Download describes a download of url, nothing is requested until Start
+type Download struct {
+	url string
+	cfg config
+}
+
+func (c *Client) Download(url string, opts ...Option) *Download {
+	return &Download{url: url, cfg: c.config(opts)}
+}
+
+// Open gives random access to a remote file, only the blocks that are read are downloaded. It needs a
+// server with range support, WithChunkSize sets the block size and WithWorkers the parallel requests
+// (default 8). The file has to be closed
+func (c *Client) Open(ctx context.Context, url string, opts ...Option) (*RemoteFile, error) {
+	cfg := c.config(opts)
+
+	primary, err := downloader.Probe(ctx, url, cfg.header)
+	if err != nil {
+		return nil, err
+	}
+	if !primary.AcceptRange || primary.TotalSize <= 0 {
+		return nil, fmt.Errorf("%s does not support range requests", url)
+	}
+	mirrors, _, err := downloader.ProbeMirrors(ctx, primary, cfg.mirrors, cfg.header)
+	if err != nil {
+		return nil, err
+	}
+
+	rf := downloader.NewRemoteFile(url, primary.TotalSize, primary.Validators)
+	rf.Mirrors = mirrors
+	rf.Header = cfg.header
+	rf.RetryPolicy.MaxRetries = max(cfg.retries, 1)
+	if cfg.workers > 0 {
+		rf.Workers = cfg.workers
+	}
+	if cfg.chunkSize > 0 {
+		rf.BlockSize = cfg.chunkSize
+	}
+	if cfg.cacheSize > 0 {
+		rf.CacheBlocks = int(max(cfg.cacheSize/rf.BlockSize, 1))
+	}
+	if cfg.readahead >= 0 {
+		rf.Readahead = cfg.readahead
+	}
+	return rf, nil
+}
+
+// Start probes the server and starts the download in the background, errors found before any
+// bytes are requested (bad URL, unreachable server, invalid checksum) are returned here.
+// Cancelling ctx cancels the download
+func (d *Download) Start(ctx context.Context) (*Handle, error) {
+	cfg := d.cfg
+
+	primary, err := downloader.Probe(ctx, d.url, cfg.header)
+	if err != nil {
+		return nil, err
+	}
+	acceptRange := primary.AcceptRange && primary.TotalSize > 0
+
+	var checksum *downloader.ChecksumInfo
+	if cfg.algorithm != "" || cfg.hash != "" {
+		checksum, err = downloader.NewChecksumInfo(cfg.algorithm, cfg.hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filename := downloader.OutputPath(cfg.output, primary.Filename)
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	h := &Handle{filename: filename, cancel: cancel, done: make(chan struct{})}
+
+	if acceptRange {
+		mirrors, _, err := downloader.ProbeMirrors(ctx, primary, cfg.mirrors, cfg.header)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		rdi, err := downloader.InitRangeDownloadInfo(filename, primary.TotalSize, d.url, primary.Validators, downloader.StatusFlags{})
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		rdi.Mirrors = mirrors
+		if cfg.workers > 0 {
+			rdi.SetWorkerLimit(cfg.workers)
+		}
+		rdi.RetryPolicy.MaxRetries = max(cfg.retries, 1)
+		rdi.Header = cfg.header
+		rdi.ChunkSize = cfg.chunkSize
+		rdi.Sequential = cfg.sequential
+		rdi.Checksum = checksum
+
+		h.rdi = rdi
+		h.events = rdi.Events
+		h.subscribe(cfg.subscribers)
+		go rdi.StartHealthMonitor(ctx)
+		go h.run(func() error { return rdi.RangeDownload(ctx) })
+	} else {
+		sdi, err := downloader.InitStreamDownloadInfo(filename, d.url, primary.Validators, downloader.StatusFlags{})
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		sdi.Header = cfg.header
+		sdi.RetryPolicy.MaxRetries = max(cfg.retries, 1)
+		sdi.Checksum = checksum
+
+		h.events = sdi.Events
+		h.subscribe(cfg.subscribers)
+		go h.run(func() error { return sdi.StreamDownload(ctx) })
+	}
+	return h, nil
+}
+
+// Reader streams a remote file in order while several workers fetch the ranges ahead of it, for piping a
+// download into a decompressor or parser without writing it to disk. It needs a server with range
+// support, the checksum (if set) is verified when the last byte is read. Cancelling ctx or closing the
+// reader stops the workers
+func (c *Client) Reader(ctx context.Context, url string, opts ...Option) (*ParallelReader, error) {
+	cfg := c.config(opts)
+
+	primary, err := downloader.Probe(ctx, url, cfg.header)
+	if err != nil {
+		return nil, err
+	}
+	if !primary.AcceptRange || primary.TotalSize <= 0 {
+		return nil, fmt.Errorf("%s does not support range requests", url)
+	}
+	mirrors, _, err := downloader.ProbeMirrors(ctx, primary, cfg.mirrors, cfg.header)
+	if err != nil {
+		return nil, err
+	}
+
+	pr := downloader.NewParallelReader(url, primary.TotalSize, primary.Validators)
+	if cfg.algorithm != "" || cfg.hash != "" {
+		if pr.Checksum, err = downloader.NewChecksumInfo(cfg.algorithm, cfg.hash); err != nil {
+			return nil, err
+		}
+	}
+	pr.Mirrors = mirrors
+	pr.Header = cfg.header
+	pr.RetryPolicy.MaxRetries = max(cfg.retries, 1)
+	if cfg.workers > 0 {
+		pr.Workers = cfg.workers
+	}
+	if cfg.chunkSize > 0 {
+		pr.ChunkSize = cfg.chunkSize
+	}
+	pr.BufferSize = cfg.bufferSize
+	for _, s := range cfg.subscribers {
+		pr.Events.Subscribe(s)
+	}
+	pr.Start(ctx)
+	return pr, nil
+}
+
+// <== Helper Functions ==>
+func (c *Client) config(opts []Option) config {
+	cfg := config{retries: downloader.DefaultRetryPolicy.MaxRetries, readahead: -1}
+	for _, opt := range c.opts {
+		opt(&cfg)
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
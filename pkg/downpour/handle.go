@@ -0,0 +1,89 @@
+package downpour
+
+import (
+	"sync/atomic"
+
+	"downpour/internal/downloader"
+)
+
+// Handle is a running download
+type Handle struct {
+	filename string
+	rdi      *downloader.RangeDownloadInfo // nil for a streamed download
+	events   *downloader.EventBus
+	cancel   func()
+	written  atomic.Int64
+	total    atomic.Int64
+	err      error
+	done     chan struct{}
+}
+
+// Progress returns the bytes on disk and the size of the file, total is -1 when the server did not say
+func (h *Handle) Progress() (written int64, total int64) {
+	if h.rdi != nil {
+		return h.rdi.BytesWritten.Load(), h.rdi.TotalSize
+	}
+	return h.written.Load(), h.total.Load()
+}
+
+// Snapshot returns the statistics of every worker, a streamed download only fills in the byte counts
+func (h *Handle) Snapshot() Snapshot {
+	if h.rdi != nil {
+		return h.rdi.Snapshot()
+	}
+	written, total := h.Progress()
+	return Snapshot{BytesWritten: written, TotalSize: total}
+}
+
+// Subscribe adds a subscriber to a running download, events published before it was added are not
+// delivered to it (use WithSubscriber to get all of them)
+func (h *Handle) Subscribe(s Subscriber) (unsubscribe func()) {
+	return h.events.Subscribe(s)
+}
+
+// Wait blocks until the download is over and every subscriber handled its last event
+func (h *Handle) Wait() error {
+	<-h.done
+	return h.err
+}
+
+// Done is closed once the download is over
+func (h *Handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Cancel stops the download, a range download keeps the partial file so a later one resumes it
+func (h *Handle) Cancel() {
+	h.cancel()
+}
+
+// Filename is the path the file is written to
+func (h *Handle) Filename() string {
+	return h.filename
+}
+
+// <== Helper Functions ==>
+func (h *Handle) subscribe(subscribers []Subscriber) {
+	if h.rdi == nil {
+		// a streamed download has no counters of its own to read
+		h.total.Store(-1)
+		h.events.Subscribe(SubscriberFunc(func(e Event) {
+			switch e := e.(type) {
+			case Started:
+				h.total.Store(e.TotalSize)
+			case Progress:
+				h.written.Store(e.Total)
+			}
+		}))
+	}
+	for _, s := range subscribers {
+		h.events.Subscribe(s)
+	}
+}
+
+func (h *Handle) run(download func() error) {
+	h.err = download()
+	h.cancel()
+	h.events.Close()
+	close(h.done)
+}
@@ -0,0 +1,33 @@
+package downpour
+
+import (
+	"net/http"
+
+	"downpour/internal/downloader"
+)
+
+// Transport speeds up large downloads of an existing http.Client. A GET whose response is at least
+// Threshold (16MB by default) and advertises byte ranges gets a body that is fetched by parallel
+// range requests through Base and read back in order, everything else passes through untouched
+type Transport = downloader.Transport
+
+// NewTransport wraps base, WithWorkers, WithChunkSize, WithBufferSize, WithRetries and WithSubscriber apply
+// to every accelerated response. A subscriber sees the events of concurrent responses one at a time
+func NewTransport(base http.RoundTripper, opts ...Option) *Transport {
+	cfg := config{retries: downloader.DefaultRetryPolicy.MaxRetries}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	t := downloader.NewTransport(base)
+	t.RetryPolicy.MaxRetries = max(cfg.retries, 1)
+	if cfg.workers > 0 {
+		t.Workers = cfg.workers
+	}
+	if cfg.chunkSize > 0 {
+		t.ChunkSize = cfg.chunkSize
+	}
+	t.BufferSize = cfg.bufferSize
+	t.Subscribers = cfg.subscribers
+	return t
+}
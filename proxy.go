@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"downpour/internal/proxy"
+	"downpour/internal/ui"
+)
+
+// runProxy implements `downpour proxy [--listen addr] [--cache dir]`
+func runProxy(args []string) {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listenFlag := fs.String("listen", "127.0.0.1:8118", "Address to listen on")
+	cacheFlag := fs.String("cache", "", "Keep finished large files in this directory (keyed by URL and ETag)")
+	minSizeFlag := fs.Int64("min-size", 16, "Smallest response in MB that is fetched with parallel ranges")
+	workersFlag := fs.Int("workers", 8, "Parallel range requests per accelerated response")
+	fs.IntVar(workersFlag, "w", 8, "Parallel range requests per accelerated response (shorthand)")
+	fs.Usage = ui.PrintHelp
+	fs.Parse(args)
+
+	server := proxy.NewServer()
+	server.CacheDir = *cacheFlag
+	server.Transport.Threshold = max(*minSizeFlag, 1) * 1024 * 1024
+	server.Transport.Workers = max(*workersFlag, 1)
+	server.Log = os.Stderr
+
+	fmt.Fprintf(os.Stderr, "downpour proxy listening on %s\n", *listenFlag)
+	if err := http.ListenAndServe(*listenFlag, server); err != nil {
+		startErrorUI(err)
+	}
+}
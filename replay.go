@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"downpour/internal/downloader"
+	"downpour/internal/ui"
+)
+
+// runReplay implements `downpour replay <telemetry.csv> [--policy name[,name...]]`
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	policyFlag := fs.String("policy", "all", "Health policies to replay, comma separated, or all: "+strings.Join(downloader.HealthPolicyNames(), ", "))
+	fs.Usage = ui.PrintHelp
+
+	// accept the flags before and after the file name
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		startErrorUI(fmt.Errorf("replay needs a telemetry CSV"))
+		return
+	}
+	path := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+
+	names := downloader.HealthPolicyNames()
+	if *policyFlag != "all" {
+		names = strings.Split(*policyFlag, ",")
+	}
+	var policies []downloader.HealthPolicy
+	for _, name := range names {
+		policy, err := downloader.HealthPolicyByName(strings.TrimSpace(name))
+		if err != nil {
+			startErrorUI(err)
+			return
+		}
+		policies = append(policies, policy)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		startErrorUI(err)
+		return
+	}
+	defer file.Close()
+
+	telemetry, err := downloader.LoadTelemetry(file)
+	if err != nil {
+		startErrorUI(fmt.Errorf("%s - %w", path, err))
+		return
+	}
+
+	reports := make([]downloader.ReplayReport, len(policies))
+	for i, policy := range policies {
+		reports[i] = telemetry.Replay(policy)
+	}
+	ui.PrintReplayReport(telemetry, reports)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"downpour/internal/downloader"
+)
+
+// startServer serves the file being downloaded on addr for players and VMs that read it while it
+// downloads, it returns the URL to open
+func startServer(addr string, pf *downloader.PartialFile, filename string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", fmt.Errorf("could not serve on %s - %w", addr, err)
+	}
+
+	name := filepath.Base(filename)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Range requests are answered by ServeContent, every read waits for its bytes to be downloaded
+		content := io.NewSectionReader(requestReader{ctx: r.Context(), pf: pf}, 0, pf.Size())
+		http.ServeContent(w, r, name, time.Time{}, content)
+	})
+	go http.Serve(listener, handler)
+
+	host := "localhost"
+	if ip := listener.Addr().(*net.TCPAddr).IP; !ip.IsUnspecified() {
+		host = ip.String()
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	return fmt.Sprintf("http://%s/%s", net.JoinHostPort(host, fmt.Sprint(port)), name), nil
+}
+
+// <== Helper Functions ==>
+
+// requestReader stops waiting for missing bytes once the client went away
+type requestReader struct {
+	ctx context.Context
+	pf  *downloader.PartialFile
+}
+
+func (r requestReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.pf.ReadAtContext(r.ctx, p, off)
+}